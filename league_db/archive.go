@@ -0,0 +1,160 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Every row of the fetched tables records the API uri it came from, in
+// source_uri, and when the response was fetched from the API, in fetched_at.
+// The API cache doesn't say whether a response came from it, so the manifest
+// keeps the time each response was fetched along with a hash of its body and
+// when it expires from the cache; the same body got again before then came
+// from the cache.  With -archive, the responses themselves are kept too, in
+// <dir>/raw/<sync time>.ndjson.gz, a line of JSON with the uri, fetched_at and
+// body per response, so that what a sync was built from can be told apart from
+// what iRacing returns now and the tables can be rebuilt without the API.
+// Archives are never written to once a sync is over and, like parquet files,
+// are hard linked rather than copied into the staging directory.  Failing to
+// write to the archive aborts the sync once its fetching is done, rather than
+// committing a dataset that can't be rebuilt from its archive.
+
+const (
+	archiveDir    = "raw"
+	archiveSuffix = ".ndjson.gz"
+)
+
+type archivedResponse struct {
+	URI       string          `json:"uri"`
+	FetchedAt time.Time       `json:"fetched_at"`
+	Body      json.RawMessage `json:"body"`
+}
+
+// archive is the archive of a sync.  Responses are added to it from the
+// goroutines that fetch lap data and event logs as well.
+type archive struct {
+	mu   sync.Mutex
+	file *os.File
+	gz   *gzip.Writer
+	enc  *json.Encoder
+
+	// the first error writing to the archive, after which nothing is added
+	err error
+}
+
+// OpenArchive starts the archive of this sync, unless there isn't going to be
+// one
+func (l *League) OpenArchive() error {
+	if !l.opts.Archive {
+		return nil
+	}
+
+	dir := filepath.Join(l.dir, archiveDir)
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z")+archiveSuffix))
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(f)
+
+	l.archive = &archive{file: f, gz: gz, enc: json.NewEncoder(gz)}
+
+	return nil
+}
+
+// CloseArchive finishes the archive of this sync
+func (l *League) CloseArchive() error {
+	a := l.archive
+	if a == nil {
+		return nil
+	}
+
+	l.archive = nil
+
+	if a.err != nil {
+		a.gz.Close()
+		a.file.Close()
+		return fmt.Errorf("the archive %s is incomplete, not committing the sync: %w", a.file.Name(), a.err)
+	}
+
+	err := a.gz.Close()
+	if err != nil {
+		a.file.Close()
+		return err
+	}
+
+	return a.file.Close()
+}
+
+// add appends a response to the archive, unless writing to it has failed
+// already
+func (a *archive) add(uri string, fetchedAt time.Time, body []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err != nil {
+		return
+	}
+
+	err := a.enc.Encode(archivedResponse{uri, fetchedAt, body})
+	if err != nil {
+		a.err = fmt.Errorf("archiving %s: %w", uri, err)
+		log.Printf("Archiving failed, the sync will be aborted once it is done fetching: %v", a.err)
+	}
+}
+
+// fetched records when the response to uri, got from the API or from its
+// cache, was fetched from the API, archiving body if there is an archive.
+// Failing to look that up in the manifest is logged and the response taken to
+// be fetched now.
+func (l *League) fetched(uri string, ttl time.Duration, body []byte) {
+	bodyHash := fmt.Sprintf("%x", sha256.Sum256(body))
+
+	fetchedAt, expiresAt, cached, err := l.ResponseFetchedAt(uri, bodyHash)
+	if err != nil {
+		log.Printf("Looking up when %s was fetched: %v", uri, err)
+	}
+
+	if !cached {
+		// as precise as the manifest keeps it
+		fetchedAt = time.Now().UTC().Truncate(time.Microsecond)
+		expiresAt = fetchedAt.Add(ttl)
+	}
+
+	err = l.RecordResponse(uri, bodyHash, fetchedAt, expiresAt)
+	if err != nil {
+		log.Printf("Recording when %s was fetched: %v", uri, err)
+	}
+
+	l.mu.Lock()
+	l.fetchedAt[uri] = fetchedAt
+	l.mu.Unlock()
+
+	if l.archive != nil {
+		l.archive.add(uri, fetchedAt, body)
+	}
+}
+
+// setSource sets the provenance columns of the rows in data, which came from
+// uri
+func (l *League) setSource(data interface{}, uri string) {
+	l.mu.Lock()
+	fetchedAt := l.fetchedAt[uri]
+	l.mu.Unlock()
+
+	setColumn(data, "source_uri", uri)
+	setColumn(data, "fetched_at", fetchedAt.Format(time.RFC3339Nano))
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// duckStore keeps tables in a persistent DuckDB database and inserts rows as
+// they are fetched.  The parquet files are only exported from it by Save.
+type duckStore struct {
+	db  *sql.DB
+	dir string
+
+	// the partitions of each partitioned table written to since it was saved
+	touched map[string]map[partition]bool
+
+	// whether the parquet files may be newer than the tables in the database,
+	// see StoreStale
+	stale bool
+}
+
+// tableName maps table names to something that doesn't need quoting in SQL
+func tableName(table string) string {
+	return strings.ReplaceAll(table, "-", "_")
+}
+
+func (s *duckStore) Exists(table string) (bool, error) {
+	var exists bool
+
+	err := s.db.QueryRowContext(context.Background(),
+		"SELECT EXISTS (FROM duckdb_tables() WHERE database_name=current_database() AND table_name=?)",
+		tableName(table)).Scan(&exists)
+
+	return exists, err
+}
+
+// Load imports <dir>/<table>.parquet into the database the first time a
+// dataset that was created without -duckdb is synced with it, and again when it
+// has been synced without -duckdb since, so that Save never exports stale rows
+// over newer ones
+func (s *duckStore) Load(table string) error {
+	exists, err := s.Exists(table)
+	if err != nil || exists && !s.stale {
+		return err
+	}
+
+	fn := fmt.Sprintf("%s/%s.parquet", s.dir, table)
+	query := fmt.Sprintf("read_parquet('%s')", fn)
+
+	if partitioned[table] {
+		fn = fmt.Sprintf("%s/%s", s.dir, table)
+		query = readPartitions(s.dir, table)
+	}
+
+	exists, err = fileExists(fn)
+	if err != nil {
+		return err
+	}
+
+	sql := fmt.Sprintf("CREATE OR REPLACE TABLE %s AS FROM %s", tableName(table), query)
+	if !exists {
+		sql = fmt.Sprintf("DROP TABLE IF EXISTS %s", tableName(table))
+	}
+
+	_, err = s.db.ExecContext(context.Background(), sql)
+
+	return err
+}
+
+// Write inserts data into table coerced into the table's schema, replacing the
+// rows with the same keys.  The rows are passed to DuckDB as a parameter and
+// held in the write_rows temp table while they're inserted.
+func (s *duckStore) Write(data any, table string, part string) error {
+	rows, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	// a single row is written as a list of one
+	if bytes.HasPrefix(rows, []byte("{")) {
+		rows = slices.Concat([]byte("["), rows, []byte("]"))
+	}
+
+	_, err = s.db.ExecContext(context.Background(),
+		fmt.Sprintf("CREATE OR REPLACE TEMP TABLE write_rows AS %s", fromJson(table)), string(rows))
+	if err != nil {
+		return err
+	}
+
+	defer s.db.ExecContext(context.Background(), "DROP TABLE write_rows")
+
+	exists, err := s.Exists(table)
+	if err != nil {
+		return err
+	}
+
+	name := tableName(table)
+
+	if partitioned[table] {
+		if s.touched[table] == nil {
+			s.touched[table] = map[partition]bool{}
+		}
+
+		partitions, err := partitionsOf(s.db, "FROM write_rows")
+		if err != nil {
+			return err
+		}
+
+		for _, p := range partitions {
+			s.touched[table][p] = true
+
+			if snapshot[table] && exists {
+				_, err := s.db.ExecContext(context.Background(),
+					fmt.Sprintf("DELETE FROM %s WHERE league_id=? AND season_id=?", name),
+					p.leagueId, p.seasonId)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	sql := fmt.Sprintf("INSERT INTO %s BY NAME %s", name, upsertQuery(table, "write_rows"))
+	if !exists {
+		sql = fmt.Sprintf("CREATE TABLE %s AS %s", name, upsertQuery(table, "write_rows"))
+	} else {
+		err = s.deleteKeys(table, "write_rows")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.db.ExecContext(context.Background(), sql)
+
+	return err
+}
+
+// deleteKeys deletes the rows of table with the same primary keys as the rows
+// returned by query
+func (s *duckStore) deleteKeys(table string, query string) error {
+	keys := primaryKeys[table]
+
+	columns := make([]string, len(keys))
+	matches := make([]string, len(keys))
+
+	for i, k := range keys {
+		columns[i] = fmt.Sprintf("%s AS k%d", k, i)
+		matches[i] = fmt.Sprintf("%s.%s IS NOT DISTINCT FROM n.k%d", tableName(table), k, i)
+	}
+
+	_, err := s.db.ExecContext(context.Background(), fmt.Sprintf("DELETE FROM %s USING (SELECT %s FROM %s) n WHERE %s",
+		tableName(table), strings.Join(columns, ", "), query, strings.Join(matches, " AND ")))
+
+	return err
+}
+
+// Clear deletes the rows of a league from table.  Rows written before tables
+// had a league_id can't be told apart so they are all deleted.
+func (s *duckStore) Clear(table string, leagueId int) error {
+	exists, err := s.Exists(table)
+	if !exists {
+		return err
+	}
+
+	name := tableName(table)
+
+	sql := fmt.Sprintf("DELETE FROM %s", name)
+
+	names, _, err := columns(s.db, name)
+	if err != nil {
+		return err
+	}
+
+	if containsFold(names, "league_id") {
+		sql = fmt.Sprintf("DELETE FROM %s WHERE league_id=%d", name, leagueId)
+	}
+
+	_, err = s.db.ExecContext(context.Background(), sql)
+
+	return err
+}
+
+// Merge has nothing to do as rows go straight into their tables
+func (s *duckStore) Merge(table string) error {
+	return nil
+}
+
+// Save exports table to <dir>/<table>.parquet.  Partitioned tables only have
+// the partitions that were written to exported, unless they've never been
+// exported at all.
+func (s *duckStore) Save(table string) error {
+	exists, err := s.Exists(table)
+	if !exists {
+		return err
+	}
+
+	if partitioned[table] {
+		return s.savePartitions(table)
+	}
+
+	return copyToParquet(s.db, fmt.Sprintf("SELECT * FROM %s", tableName(table)),
+		fmt.Sprintf("%s/%s.parquet", s.dir, table))
+}
+
+// Migrate rewrites table in its schema, exporting all of it if it's partitioned
+// as there's no telling which partitions were touched
+func (s *duckStore) Migrate(table string, version int) error {
+	tmp := fmt.Sprintf("%s/TMP_%s.json", s.dir, table)
+
+	defer os.Remove(tmp)
+
+	for _, sql := range []string{
+		fmt.Sprintf("COPY (%s) TO '%s'", upgradeQuery(table, version, tableName(table)), tmp),
+		fmt.Sprintf("CREATE OR REPLACE TABLE %s AS SELECT * FROM %s", tableName(table), readJson(table, tmp)),
+	} {
+		_, err := s.db.ExecContext(context.Background(), sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	if partitioned[table] {
+		return writePartitions(s.db, s.dir, fmt.Sprintf("SELECT * FROM %s", tableName(table)), table)
+	}
+
+	return nil
+}
+
+func (s *duckStore) savePartitions(table string) error {
+	query := fmt.Sprintf("SELECT * FROM %s", tableName(table))
+
+	exported, err := fileExists(fmt.Sprintf("%s/%s", s.dir, table))
+	if err != nil {
+		return err
+	}
+
+	if exported {
+		if len(s.touched[table]) == 0 {
+			return nil
+		}
+
+		var keys []string
+		for p := range s.touched[table] {
+			keys = append(keys, fmt.Sprintf("(%d, %d)", p.leagueId, p.seasonId))
+		}
+
+		query = fmt.Sprintf("%s WHERE (league_id, season_id) IN (%s)", query, strings.Join(keys, ", "))
+	}
+
+	err = writePartitions(s.db, s.dir, query, table)
+	if err != nil {
+		return err
+	}
+
+	delete(s.touched, table)
+
+	return nil
+}
+
+func (s *duckStore) SessionExists(table string, subsessionId int) (bool, error) {
+	exists, err := s.Exists(table)
+	if !exists {
+		return false, err
+	}
+
+	sql := fmt.Sprintf("SELECT EXISTS (FROM %s WHERE subsession_id=?)", tableName(table))
+
+	err = s.db.QueryRowContext(context.Background(), sql, subsessionId).Scan(&exists)
+
+	return exists, err
+}
+
+func (s *duckStore) Query(table string) string {
+	return tableName(table)
+}
+
+// Derive replaces table with the results of query and exports it to parquet
+func (s *duckStore) Derive(table string, query string) error {
+	sql := fmt.Sprintf("CREATE OR REPLACE TABLE %s AS %s", tableName(table), query)
+
+	_, err := s.db.ExecContext(context.Background(), sql)
+	if err != nil {
+		return err
+	}
+
+	return s.Save(table)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The event log of a simsession has the penalties, disqualifications and race
+// control messages handed out during it.  Each event is a row of the event_log
+// table, keyed by subsession, simsession, cust_id (group_id for teams) and
+// session time, next to the results of the same simsession.  A driver can get
+// more than one event at the same session time, e.g. a penalty and the message
+// that goes with it, so event_seq breaks the tie.
+
+// FetchEventLogs fetches the event log of each of the simsessions of a
+// subsession the way FetchLapData fetches lap data.  The events of each are
+// returned in the same order as the simsessions.
+func (l *League) FetchEventLogs(subsessionId int, simsessions []map[string]interface{}) ([][]interface{}, error) {
+	uris := make([]string, len(simsessions))
+
+	for i, s := range simsessions {
+		simsessionNumber, err := number(s, "simsession_number")
+		if err != nil {
+			return nil, err
+		}
+
+		uris[i] = fmt.Sprintf("/data/results/event_log?subsession_id=%d&simsession_number=%d",
+			subsessionId, simsessionNumber)
+	}
+
+	logs, err := l.fetchAll(uris)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([][]interface{}, len(logs))
+
+	for i, r := range logs {
+		// simsessions without any events have no chunks at all
+		if r["_chunk_data"] == nil {
+			continue
+		}
+
+		events[i], err = list(r, "_chunk_data")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", uris[i], err)
+		}
+
+		l.setSource(events[i], uris[i])
+	}
+
+	return events, nil
+}
+
+// writeEventLog writes the events of a simsession to event_log
+func (l *League) writeEventLog(leagueId int, seasonId int, subsessionId int, simsessionNumber int, events []interface{}) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	setColumn(events, "league_id", leagueId)
+	setColumn(events, "season_id", seasonId)
+	setColumn(events, "subsession_id", subsessionId)
+	setColumn(events, "simsession_number", simsessionNumber)
+
+	return l.write(events, "event_log", fmt.Sprintf("%d_%d", subsessionId, simsessionNumber))
+}
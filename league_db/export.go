@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// The export command copies tables out of the dataset, partitioned tables as
+// a single file each, for tools that can't read Hive partitioned parquet.
+
+var exportFormats = map[string]string{
+	"csv":     "FORMAT CSV, HEADER",
+	"json":    "FORMAT JSON",
+	"parquet": "FORMAT PARQUET",
+	"duckdb":  "",
+}
+
+func exportCommand(fs *flag.FlagSet, args []string) error {
+	var dir, format, out string
+
+	dirFlag(fs, &dir)
+	fs.StringVar(&format, "format", "csv", "export format, one of csv, json, parquet or duckdb")
+	fs.StringVar(&out, "out", "export", "the directory to export to, or the database file for duckdb")
+
+	fs.Parse(args)
+
+	_, ok := exportFormats[format]
+	if !ok {
+		return fmt.Errorf("not an export format: %s", format)
+	}
+
+	db, views, err := openDataset(dir)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	export := views
+
+	if fs.NArg() > 0 {
+		export = fs.Args()
+
+		for _, table := range export {
+			if !slices.Contains(views, table) {
+				return fmt.Errorf("not a table in %s: %s", dir, table)
+			}
+		}
+	}
+
+	if format == "duckdb" {
+		return exportDuckDB(db, export, out)
+	}
+
+	err = os.MkdirAll(out, 0755)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range export {
+		fn := filepath.Join(out, fmt.Sprintf("%s.%s", table, format))
+
+		log.Printf("Exporting %s to %s", table, fn)
+
+		sql := fmt.Sprintf("COPY %s TO '%s' (%s)", tableName(table), fn, exportFormats[format])
+		_, err = db.ExecContext(context.Background(), sql)
+		if err != nil {
+			return fmt.Errorf("exporting %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+// exportDuckDB copies tables into the DuckDB database fn replacing any tables
+// of the same names
+func exportDuckDB(db *sql.DB, tables []string, fn string) error {
+	_, err := db.ExecContext(context.Background(), fmt.Sprintf("ATTACH '%s' AS export", fn))
+	if err != nil {
+		return err
+	}
+
+	defer db.ExecContext(context.Background(), "DETACH export")
+
+	for _, table := range tables {
+		log.Printf("Exporting %s to %s", table, fn)
+
+		sql := fmt.Sprintf("CREATE OR REPLACE TABLE export.%s AS FROM %s", tableName(table), tableName(table))
+		_, err = db.ExecContext(context.Background(), sql)
+		if err != nil {
+			return fmt.Errorf("exporting %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
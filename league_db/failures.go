@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A sync carries on when a league, season or session can't be fetched.  What
+// failed is skipped, left out of the manifest and listed in
+// <dir>/failures.json, which -retry takes to sync just those again.
+
+const failuresFile = "failures.json"
+
+// failure is a league, season or session that couldn't be synced.  The ids
+// below the level it failed at are zero.
+type failure struct {
+	LeagueId     int    `json:"league_id"`
+	SeasonId     int    `json:"season_id,omitempty"`
+	SubsessionId int    `json:"subsession_id,omitempty"`
+	Error        string `json:"error"`
+}
+
+func (f failure) String() string {
+	switch {
+	case f.SubsessionId != 0:
+		return fmt.Sprintf("subsession %d (league %d, season %d)", f.SubsessionId, f.LeagueId, f.SeasonId)
+	case f.SeasonId != 0:
+		return fmt.Sprintf("season %d (league %d)", f.SeasonId, f.LeagueId)
+	}
+
+	return fmt.Sprintf("league %d", f.LeagueId)
+}
+
+// stats counts what a sync did for its summary
+type stats struct {
+	leagues         int
+	seasons         int
+	skippedSeasons  int
+	sessions        int
+	skippedSessions int
+}
+
+func (l *League) fail(leagueId int, seasonId int, subsessionId int, err error) {
+	f := failure{leagueId, seasonId, subsessionId, err.Error()}
+
+	log.Printf("Skipping %s: %v", f, err)
+
+	l.failures = append(l.failures, f)
+}
+
+// wanted reports whether a league, season or session is to be synced, which
+// is always unless failures are being retried.  Zero ids match anything.
+func (l *League) wanted(leagueId int, seasonId int, subsessionId int) bool {
+	if l.opts.Retry == nil {
+		return true
+	}
+
+	matches := func(a int, b int) bool {
+		return a == 0 || b == 0 || a == b
+	}
+
+	for _, f := range l.opts.Retry {
+		if f.LeagueId == leagueId && matches(f.SeasonId, seasonId) && matches(f.SubsessionId, subsessionId) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteFailures writes the failures of the sync, if any, to <dir>/failures.json
+// replacing those of the previous sync
+func (l *League) WriteFailures() error {
+	fn := fmt.Sprintf("%s/%s", l.dir, failuresFile)
+
+	if len(l.failures) == 0 {
+		err := os.Remove(fn)
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	data, err := json.MarshalIndent(l.failures, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(fn, data, 0644)
+}
+
+func ReadFailures(fn string) ([]failure, error) {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []failure
+
+	err = json.Unmarshal(data, &failures)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+
+	return failures, nil
+}
+
+func (l *League) PrintSummary() {
+	log.Printf("Synced %d leagues, %d seasons (%d retired ones skipped) and %d sessions (%d synced before)",
+		l.stats.leagues, l.stats.seasons, l.stats.skippedSeasons, l.stats.sessions, l.stats.skippedSessions)
+
+	if len(l.failures) == 0 {
+		return
+	}
+
+	lines := make([]string, len(l.failures))
+	for i, f := range l.failures {
+		lines[i] = fmt.Sprintf("%s: %s", f, f.Error)
+	}
+
+	log.Printf("%d failed, retry them with -retry %s:\n  %s",
+		len(l.failures), filepath.Join(l.opts.DataDir, failuresFile), strings.Join(lines, "\n  "))
+}
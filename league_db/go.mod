@@ -5,6 +5,8 @@ go 1.23
 require (
 	github.com/marcboeker/go-duckdb v1.8.3
 	github.com/popmonkey/irdata v0.4.5
+	golang.org/x/sync v0.9.0
+	golang.org/x/time v0.8.0
 )
 
 require (
@@ -26,7 +28,6 @@ require (
 	github.com/zeebo/xxh3 v1.0.2 // indirect
 	golang.org/x/exp v0.0.0-20241108190413-2d47ceb2692f // indirect
 	golang.org/x/mod v0.22.0 // indirect
-	golang.org/x/sync v0.9.0 // indirect
 	golang.org/x/sys v0.27.0 // indirect
 	golang.org/x/term v0.21.0 // indirect
 	golang.org/x/tools v0.27.0 // indirect
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The roster table only has the current members of a league.  The
+// roster_history table keeps track of them across syncs with a row per member
+// for every period in which their nickname, admin and owner flags and the date
+// they joined the league didn't change:
+//
+//   - valid_from, the sync at which the member was first seen that way
+//   - valid_to, the sync at which they had changed or left, NULL while they
+//     haven't
+//   - last_seen, the last sync at which they were seen that way
+//
+// Syncs only know what the roster was like when they ran so changes are dated
+// to the first sync that saw them.
+
+const rosterHistoryTable = "roster_history"
+
+// rosterHistoryColumns are the columns of roster that are kept track of
+const rosterHistoryColumns = "league_id, cust_id, nick_name, admin, owner, league_member_since"
+
+// processRosterHistory adds the rosters of the leagues synced this time to
+// roster_history
+func (l *League) processRosterHistory() error {
+	if !l.fetches("roster") {
+		return nil
+	}
+
+	exists, err := l.store.Exists("roster")
+	if !exists {
+		return err
+	}
+
+	// the rosters of the leagues that were synced, the others are as they were
+	synced := "SELECT league_id FROM pending_leagues"
+
+	current := fmt.Sprintf("SELECT %s FROM %s WHERE league_id IN (%s)",
+		rosterHistoryColumns, l.store.Query("roster"), synced)
+
+	query := fmt.Sprintf(`
+		SELECT *, now()::TIMESTAMP AS valid_from, NULL::TIMESTAMP AS valid_to, now()::TIMESTAMP AS last_seen
+		FROM (%s)
+		ORDER BY league_id, cust_id`, current)
+
+	exists, err = l.store.Exists(rosterHistoryTable)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		query = fmt.Sprintf(`
+			WITH
+				current AS (%s),
+				history AS (
+					SELECT h.*, c.cust_id IS NOT NULL AS unchanged
+					FROM %s h
+					LEFT JOIN current c
+						ON h.valid_to IS NULL
+						AND c.league_id = h.league_id
+						AND c.cust_id = h.cust_id
+						AND c.nick_name IS NOT DISTINCT FROM h.nick_name
+						AND c.admin IS NOT DISTINCT FROM h.admin
+						AND c.owner IS NOT DISTINCT FROM h.owner
+						AND c.league_member_since IS NOT DISTINCT FROM h.league_member_since
+				)
+			SELECT * FROM (
+				SELECT
+					* EXCLUDE (unchanged) REPLACE (
+						CASE
+							WHEN valid_to IS NULL AND NOT unchanged AND league_id IN (%s) THEN now()::TIMESTAMP
+							ELSE valid_to
+						END AS valid_to,
+						CASE WHEN unchanged THEN now()::TIMESTAMP ELSE last_seen END AS last_seen)
+				FROM history
+				UNION ALL BY NAME
+				SELECT *, now()::TIMESTAMP AS valid_from, NULL::TIMESTAMP AS valid_to, now()::TIMESTAMP AS last_seen
+				FROM current c
+				WHERE NOT EXISTS (
+					FROM history h WHERE h.unchanged AND h.league_id = c.league_id AND h.cust_id = c.cust_id)
+			)
+			ORDER BY league_id, cust_id, valid_from`, current, l.store.Query(rosterHistoryTable), synced)
+	}
+
+	err = l.store.Derive(rosterHistoryTable, query)
+	if err != nil {
+		return fmt.Errorf("deriving %s: %w", rosterHistoryTable, err)
+	}
+
+	return nil
+}
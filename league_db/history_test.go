@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+type rosterMember struct {
+	leagueId int
+	custId   int
+	nickName string
+	admin    bool
+}
+
+// rosterSync is a sync of the leagues in synced, when roster was the roster of
+// every league
+type rosterSync struct {
+	synced []int
+	roster []rosterMember
+}
+
+// TestRosterHistory runs syncs with the rosters of each test and checks the
+// periods of roster_history, as "<league>/<member> <nickname> <admin>
+// <valid_from>-<valid_to> <last_seen>" with the syncs numbered from 1
+func TestRosterHistory(t *testing.T) {
+	var (
+		a  = rosterMember{1, 1, "a", false}
+		b  = rosterMember{1, 2, "b", false}
+		c  = rosterMember{2, 3, "c", false}
+		a2 = rosterMember{1, 1, "a2", false}
+		a3 = rosterMember{1, 1, "", false}
+		a4 = rosterMember{1, 1, "a", true}
+	)
+
+	tests := []struct {
+		name  string
+		syncs []rosterSync
+		want  []string
+	}{
+		{
+			"unchanged",
+			[]rosterSync{{[]int{1}, []rosterMember{a}}, {[]int{1}, []rosterMember{a}}},
+			[]string{"1/1 a false 1- 2"},
+		},
+		{
+			"joins",
+			[]rosterSync{{[]int{1}, []rosterMember{a}}, {[]int{1}, []rosterMember{a, b}}},
+			[]string{"1/1 a false 1- 2", "1/2 b false 2- 2"},
+		},
+		{
+			"leaves",
+			[]rosterSync{{[]int{1}, []rosterMember{a, b}}, {[]int{1}, []rosterMember{a}}},
+			[]string{"1/1 a false 1- 2", "1/2 b false 1-2 1"},
+		},
+		{
+			"rejoins",
+			[]rosterSync{
+				{[]int{1}, []rosterMember{a, b}},
+				{[]int{1}, []rosterMember{a}},
+				{[]int{1}, []rosterMember{a, b}},
+			},
+			[]string{"1/1 a false 1- 3", "1/2 b false 1-2 1", "1/2 b false 3- 3"},
+		},
+		{
+			"changes nickname",
+			[]rosterSync{{[]int{1}, []rosterMember{a}}, {[]int{1}, []rosterMember{a2}}},
+			[]string{"1/1 a false 1-2 1", "1/1 a2 false 2- 2"},
+		},
+		{
+			"clears nickname",
+			[]rosterSync{{[]int{1}, []rosterMember{a}}, {[]int{1}, []rosterMember{a3}}, {[]int{1}, []rosterMember{a3}}},
+			[]string{"1/1 a false 1-2 1", "1/1  false 2- 3"},
+		},
+		{
+			"made admin",
+			[]rosterSync{{[]int{1}, []rosterMember{a}}, {[]int{1}, []rosterMember{a4}}},
+			[]string{"1/1 a false 1-2 1", "1/1 a true 2- 2"},
+		},
+		{
+			"other leagues left alone",
+			[]rosterSync{{[]int{1, 2}, []rosterMember{a, c}}, {[]int{1}, []rosterMember{b, c}}},
+			[]string{"1/1 a false 1-2 1", "1/2 b false 2- 2", "2/3 c false 1- 1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// the time of each sync, which is the last_seen of the members
+			// of the leagues it synced
+			syncs := map[int64]int{}
+
+			var got []string
+
+			for i, s := range tt.syncs {
+				var err error
+
+				got, err = syncRosterHistory(dir, s, i+1, syncs)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// syncRosterHistory runs the sync numbered sync, adding its time to syncs, and
+// returns the rows of roster_history after it
+func syncRosterHistory(dir string, s rosterSync, sync int, syncs map[int64]int) ([]string, error) {
+	l := &League{dir: dir}
+
+	err := l.OpenWriter()
+	if err != nil {
+		return nil, err
+	}
+
+	defer l.CloseWriter()
+
+	err = l.OpenManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.store.Derive("roster", rosterQuery(s.roster))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, leagueId := range s.synced {
+		err = l.RecordLeague(leagueId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = l.processRosterHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	history := l.store.Query(rosterHistoryTable)
+
+	var synced time.Time
+
+	err = l.db.QueryRow(fmt.Sprintf("SELECT max(last_seen) FROM %s", history)).Scan(&synced)
+	if err != nil {
+		return nil, err
+	}
+
+	syncs[synced.UnixMicro()] = sync
+
+	return rosterHistoryRows(l.db, history, syncs)
+}
+
+// rosterQuery returns the SQL that reads a roster of members
+func rosterQuery(members []rosterMember) string {
+	values := make([]string, len(members))
+
+	for i, m := range members {
+		nickName := "NULL"
+		if m.nickName != "" {
+			nickName = fmt.Sprintf("'%s'", m.nickName)
+		}
+
+		values[i] = fmt.Sprintf("(%d, %d, %s, %t)", m.leagueId, m.custId, nickName, m.admin)
+	}
+
+	return fmt.Sprintf(`
+		SELECT
+			league_id::BIGINT AS league_id,
+			cust_id::BIGINT AS cust_id,
+			nick_name::VARCHAR AS nick_name,
+			admin::BOOLEAN AS admin,
+			false AS owner,
+			'2020-01-01'::TIMESTAMP AS league_member_since
+		FROM (VALUES %s) v(league_id, cust_id, nick_name, admin)`, strings.Join(values, ", "))
+}
+
+// rosterHistoryRows returns the rows of roster_history, in history, with their
+// times as the numbers of the syncs in syncs
+func rosterHistoryRows(db *sql.DB, history string, syncs map[int64]int) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT league_id, cust_id, coalesce(nick_name, ''), admin, valid_from, valid_to, last_seen
+		FROM %s
+		ORDER BY league_id, cust_id, valid_from`, history))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var periods []string
+
+	for rows.Next() {
+		var (
+			m                 rosterMember
+			validFrom, seen   time.Time
+			validTo           sql.NullTime
+			validToSyncNumber string
+		)
+
+		err = rows.Scan(&m.leagueId, &m.custId, &m.nickName, &m.admin, &validFrom, &validTo, &seen)
+		if err != nil {
+			return nil, err
+		}
+
+		if validTo.Valid {
+			validToSyncNumber = fmt.Sprint(syncs[validTo.Time.UnixMicro()])
+		}
+
+		periods = append(periods, fmt.Sprintf("%d/%d %s %t %d-%s %d", m.leagueId, m.custId, m.nickName, m.admin,
+			syncs[validFrom.UnixMicro()], validToSyncNumber, syncs[seen.UnixMicro()]))
+	}
+
+	return periods, rows.Err()
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// lapDataRequest identifies the laps of a single driver (or team) in a simsession
+type lapDataRequest struct {
+	simsessionNumber int
+	lapperId         int
+	uri              string
+}
+
+// FetchLapData fetches lap data using up to l.opts.Concurrency requests in flight.
+// The laps are returned in the same order as the requests.  The first failure
+// cancels any requests that haven't been sent yet.
+func (l *League) FetchLapData(requests []lapDataRequest) ([]map[string]interface{}, error) {
+	uris := make([]string, len(requests))
+	for i, req := range requests {
+		uris[i] = req.uri
+	}
+
+	laps, err := l.fetchAll(uris)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, uri := range uris {
+		l.setSource(laps[i], uri)
+	}
+
+	return laps, nil
+}
+
+// fetchAll fetches uris, results being cached for resultCacheTTL, the way
+// FetchLapData does
+func (l *League) fetchAll(uris []string) ([]map[string]interface{}, error) {
+	responses := make([]map[string]interface{}, len(uris))
+
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(l.opts.Concurrency)
+
+	for i, uri := range uris {
+		if ctx.Err() != nil {
+			break
+		}
+
+		g.Go(func() error {
+			err := l.fetch(ctx, uri, resultCacheTTL, &responses[i])
+			if err != nil {
+				return err
+			}
+
+			if responses[i] == nil {
+				return fmt.Errorf("%s: no data", uri)
+			}
+
+			return nil
+		})
+	}
+
+	err := g.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return responses, nil
+}
+
+// lapEvents are the bits of the flags of a lap that get a column of their own
+// in lap_data, and the lap_events iRacing decodes them into.  Clean laps have
+// none of the events that aren't clean.
+var lapEvents = []struct {
+	column string
+	bit    int
+	event  string
+	clean  bool
+}{
+	{"invalid", 0x0001, "invalid", false},
+	{"pitted", 0x0002, "pitted", true},
+	{"off_track", 0x0004, "off track", false},
+	{"black_flag", 0x0008, "black flag", false},
+	{"car_reset", 0x0010, "car reset", false},
+	{"contact", 0x0020, "contact", false},
+	{"car_contact", 0x0040, "car contact", false},
+	{"lost_control", 0x0080, "lost control", false},
+	{"discontinuity", 0x0100, "discontinuity", true},
+	{"interpolated_crossing", 0x0200, "interpolated crossing", true},
+	{"clock_smash", 0x0400, "clock smash", true},
+	{"tow", 0x0800, "tow", false},
+}
+
+// decodeLaps adds columns, decoded from iRacing's raw values, to the laps of
+// the lap data of every lapper in a simsession:
+//
+//   - lap_seconds, the lap time in seconds
+//   - a boolean for each of lapEvents, decoded bit by bit from flags
+//   - is_clean_lap, whether the lap was completed without incident
+//   - running_position and gap_to_leader_seconds, the order in which the laps
+//     were completed and how long after the first one, in races only
+//
+// The lap_events of a lap are only used for laps that have no flags.  Laps
+// written before there were such columns, or when they were decoded from
+// lap_events, get them from decodeLapsQuery.
+func decodeLaps(simsessionNumber int, lapData []map[string]interface{}) {
+	var laps []map[string]interface{}
+
+	for _, d := range lapData {
+		laps = append(laps, rowsOf(d["events"])...)
+	}
+
+	// the session times at which each lap was completed, in order
+	completed := map[int][]int{}
+
+	for _, lap := range laps {
+		lapNumber, _ := number(lap, "lap_number")
+		lapTime, _ := number(lap, "lap_time")
+		sessionTime, _ := number(lap, "session_time")
+		incident, _ := boolean(lap, "incident")
+		flags, flagsErr := number(lap, "flags")
+		events, _ := list(lap, "lap_events")
+
+		if lapTime > 0 {
+			lap["lap_seconds"] = float64(lapTime) / 10000
+		}
+
+		clean := lapNumber > 0 && lapTime > 0 && !incident
+
+		for _, e := range lapEvents {
+			has := flags&e.bit != 0
+			if flagsErr != nil {
+				has = slices.Contains(events, interface{}(e.event))
+			}
+
+			lap[e.column] = has
+			clean = clean && (e.clean || !has)
+		}
+
+		lap["is_clean_lap"] = clean
+
+		if simsessionNumber == 0 && sessionTime > 0 {
+			completed[lapNumber] = append(completed[lapNumber], sessionTime)
+		}
+	}
+
+	for _, times := range completed {
+		sort.Ints(times)
+	}
+
+	for _, lap := range laps {
+		lapNumber, _ := number(lap, "lap_number")
+		sessionTime, _ := number(lap, "session_time")
+
+		times := completed[lapNumber]
+
+		if simsessionNumber != 0 || sessionTime <= 0 || len(times) == 0 {
+			continue
+		}
+
+		lap["running_position"] = sort.SearchInts(times, sessionTime) + 1
+		lap["gap_to_leader_seconds"] = float64(sessionTime-times[0]) / 10000
+	}
+}
+
+// decodeLapsQuery returns the SQL that (re)decodes the columns of decodeLaps
+// for the laps of lap data, in %s, whether they have them or not
+func decodeLapsQuery() string {
+	columns := []string{
+		"lap_seconds := CASE WHEN e.lap_time > 0 THEN e.lap_time / 10000 END",
+	}
+
+	var (
+		dirtyBits   int
+		dirtyEvents []string
+	)
+
+	for _, e := range lapEvents {
+		columns = append(columns, fmt.Sprintf(`%s := CASE
+				WHEN e.flags IS NOT NULL THEN (e.flags & %d) <> 0
+				ELSE coalesce(list_contains(e.lap_events, '%s'), false)
+			END`, e.column, e.bit, e.event))
+
+		if !e.clean {
+			dirtyBits |= e.bit
+			dirtyEvents = append(dirtyEvents, fmt.Sprintf("'%s'", e.event))
+		}
+	}
+
+	columns = append(columns,
+		fmt.Sprintf(`is_clean_lap := coalesce(
+			e.lap_number > 0 AND e.lap_time > 0 AND NOT e.incident AND CASE
+				WHEN e.flags IS NOT NULL THEN (e.flags & %d) = 0
+				ELSE NOT list_has_any(e.lap_events, [%s])
+			END, false)`,
+			dirtyBits, strings.Join(dirtyEvents, ", ")),
+		"running_position := running_position",
+		"gap_to_leader_seconds := gap_to_leader_seconds")
+
+	return fmt.Sprintf(`
+		WITH lap_rows AS (
+			SELECT row_number() OVER () AS lap_row, * FROM %%s
+		),
+		laps AS (
+			SELECT
+				lap_row,
+				session_info.subsession_id AS subsession_id,
+				coalesce(session_info.simsession_number = 0, false) AS race,
+				unnest(range(len(events))) AS i,
+				unnest(events) AS e
+			FROM lap_rows
+		),
+		positions AS (
+			SELECT
+				*,
+				CASE WHEN race AND e.session_time > 0 THEN rank() OVER completed END AS running_position,
+				CASE WHEN race AND e.session_time > 0 THEN (e.session_time - min(e.session_time) OVER completed) / 10000 END AS gap_to_leader_seconds
+			FROM laps
+			WINDOW completed AS (PARTITION BY subsession_id, race, e.lap_number, e.session_time > 0 ORDER BY e.session_time)
+		),
+		decoded AS (
+			SELECT
+				lap_row,
+				from_json(
+					to_json(list(json_merge_patch(to_json(e), to_json(struct_pack(%s))) ORDER BY i)),
+					'%s') AS events
+			FROM positions
+			GROUP BY lap_row
+		)
+		SELECT r.* EXCLUDE (lap_row) REPLACE (CASE WHEN r.events IS NOT NULL THEN coalesce(d.events, []) END AS events)
+		FROM lap_rows r
+		LEFT JOIN decoded d USING (lap_row)`, strings.Join(columns, ", "), lapsType())
+}
+
+// lapsType is the structure of the laps of lap_data, for from_json.  The
+// decoded columns are merged into laps as JSON as laps decoded before already
+// have them.
+func lapsType() string {
+	for _, f := range schemas["lap_data"].fields {
+		if f.name == "events" {
+			return f.jsonType()
+		}
+	}
+
+	return ""
+}
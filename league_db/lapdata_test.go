@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// lapEventTests are laps with each of the known flags, and the lap_events
+// iRacing decodes them into, and the columns of lapEvents that should be true
+// for them
+var lapEventTests = []struct {
+	name      string
+	lapNumber int
+	lapTime   int
+	incident  bool
+	flags     int
+	events    []string
+	columns   []string
+	clean     bool
+}{
+	{"clean", 1, 900000, false, 0, nil, nil, true},
+	{"invalid", 1, 900000, false, 0x0001, []string{"invalid"}, []string{"invalid"}, false},
+	{"pitted", 1, 900000, false, 0x0002, []string{"pitted"}, []string{"pitted"}, true},
+	{"off track", 1, 900000, true, 0x0004, []string{"off track"}, []string{"off_track"}, false},
+	{"black flag", 1, 900000, false, 0x0008, []string{"black flag"}, []string{"black_flag"}, false},
+	{"car reset", 1, 900000, false, 0x0010, []string{"car reset"}, []string{"car_reset"}, false},
+	{"contact", 1, 900000, true, 0x0020, []string{"contact"}, []string{"contact"}, false},
+	{"car contact", 1, 900000, true, 0x0040, []string{"car contact"}, []string{"car_contact"}, false},
+	{"lost control", 1, 900000, true, 0x0080, []string{"lost control"}, []string{"lost_control"}, false},
+	{"discontinuity", 1, 900000, false, 0x0100, []string{"discontinuity"}, []string{"discontinuity"}, true},
+	{"interpolated crossing", 1, 900000, false, 0x0200, []string{"interpolated crossing"}, []string{"interpolated_crossing"}, true},
+	{"clock smash", 1, 900000, false, 0x0400, []string{"clock smash"}, []string{"clock_smash"}, true},
+	{"tow", 1, 900000, false, 0x0800, []string{"tow"}, []string{"tow"}, false},
+	{"several", 1, 900000, true, 0x0004 | 0x0040 | 0x0002, []string{"off track", "car contact", "pitted"}, []string{"off_track", "car_contact", "pitted"}, false},
+	{"unknown flag", 1, 900000, false, 0x1000, []string{"something new"}, nil, true},
+	{"incident without flags", 1, 900000, true, 0, nil, nil, false},
+	{"out lap", 0, 900000, false, 0, nil, nil, false},
+	{"no lap time", 1, -1, false, 0, nil, nil, false},
+}
+
+// TestDecodeLaps checks the columns decoded from the flags of laps, and from
+// their lap_events when they have no flags
+func TestDecodeLaps(t *testing.T) {
+	for _, tt := range lapEventTests {
+		for _, withFlags := range []bool{true, false} {
+			name := tt.name + "/lap_events"
+			if withFlags {
+				name = tt.name + "/flags"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				lap := map[string]interface{}{
+					"lap_number":   float64(tt.lapNumber),
+					"lap_time":     float64(tt.lapTime),
+					"session_time": float64(1000),
+					"incident":     tt.incident,
+					"lap_events":   []interface{}{},
+				}
+
+				if withFlags {
+					lap["flags"] = float64(tt.flags)
+				} else {
+					for _, e := range tt.events {
+						lap["lap_events"] = append(lap["lap_events"].([]interface{}), e)
+					}
+				}
+
+				decodeLaps(0, []map[string]interface{}{{"events": []interface{}{lap}}})
+
+				for _, e := range lapEvents {
+					if got, want := lap[e.column], slices.Contains(tt.columns, e.column); got != want {
+						t.Errorf("%s is %v, want %v", e.column, got, want)
+					}
+				}
+
+				if got := lap["is_clean_lap"]; got != tt.clean {
+					t.Errorf("is_clean_lap is %v, want %v", got, tt.clean)
+				}
+			})
+		}
+	}
+}
+
+// TestDecodeLapsQuery checks that laps written before there were decoded
+// columns, with and without flags, get the same ones as decodeLaps gives laps
+// as they are fetched
+func TestDecodeLapsQuery(t *testing.T) {
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// the laps with flags and then those without, only having lap_events
+	var laps []string
+
+	for _, withFlags := range []bool{true, false} {
+		for _, tt := range lapEventTests {
+			flags := "NULL"
+			events := []string{}
+
+			if withFlags {
+				flags = fmt.Sprint(tt.flags)
+			} else {
+				for _, e := range tt.events {
+					events = append(events, fmt.Sprintf("'%s'", e))
+				}
+			}
+
+			laps = append(laps, fmt.Sprintf(
+				"{'lap_number': %d, 'lap_time': %d, 'session_time': %d, 'incident': %t, 'flags': %s::BIGINT, 'lap_events': [%s]::VARCHAR[]}",
+				tt.lapNumber, tt.lapTime, 1000+len(laps), tt.incident, flags, strings.Join(events, ", ")))
+		}
+	}
+
+	_, err = db.Exec(fmt.Sprintf(`
+		CREATE TABLE lap_data AS
+		SELECT {'subsession_id': 1, 'simsession_number': 0} AS session_info, [%s] AS events`,
+		strings.Join(laps, ", ")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := []string{"e.is_clean_lap"}
+	for _, e := range lapEvents {
+		columns = append(columns, "e."+e.column)
+	}
+
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT %s FROM (SELECT unnest(events) AS e FROM (%s)) ORDER BY e.session_time",
+		strings.Join(columns, ", "), fmt.Sprintf(decodeLapsQuery(), "lap_data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer rows.Close()
+
+	for i := range laps {
+		tt := lapEventTests[i%len(lapEventTests)]
+
+		name := tt.name + "/flags"
+		if i >= len(lapEventTests) {
+			name = tt.name + "/lap_events"
+		}
+
+		if !rows.Next() {
+			t.Fatalf("%s: no lap", name)
+		}
+
+		clean := false
+		decoded := make([]bool, len(lapEvents))
+
+		values := []any{&clean}
+		for i := range decoded {
+			values = append(values, &decoded[i])
+		}
+
+		err = rows.Scan(values...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, e := range lapEvents {
+			if want := slices.Contains(tt.columns, e.column); decoded[i] != want {
+				t.Errorf("%s: %s is %v, want %v", name, e.column, decoded[i], want)
+			}
+		}
+
+		if clean != tt.clean {
+			t.Errorf("%s: is_clean_lap is %v, want %v", name, clean, tt.clean)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,210 +1,805 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"log"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/popmonkey/irdata"
+	"golang.org/x/time/rate"
 )
 
 const resultCacheTTL = time.Duration(4*365*24) * time.Hour // 4 years ;)
 const cacheTTL = time.Duration(1) * time.Hour
 
+const (
+	defaultConcurrency       = 4
+	defaultRequestsPerMinute = 240
+)
+
+type Options struct {
+	// maximum number of lap data requests in flight, defaultConcurrency when
+	// not set
+	Concurrency int
+	// maximum number of API requests sent per minute, defaultRequestsPerMinute
+	// when not set
+	RequestsPerMinute int
+	// keep the tables in a persistent DuckDB database rather than parquet files
+	DuckDB bool
+	// only sync what failed last time rather than everything
+	Retry []failure
+	// where the dataset and the API cache are kept
+	DataDir  string
+	CacheDir string
+	// the tables to fetch, all of them when empty
+	Tables []string
+	// keep the API responses in <dir>/raw, see archive.go
+	Archive bool
+}
+
+// League syncs one or more leagues into a single dataset
 type League struct {
-	leagueId int
-	ir       *irdata.Irdata
-	db       *sql.DB
+	leagueIds []int
+	ir        *irdata.Irdata
+	db        *sql.DB
+	store     store
+	opts      Options
+	dir       string // where the tables are written, see BeginStaging
+	limiter   *rate.Limiter
+
+	// the fields fetched for each table, see ReportSchemaDrift
+	seen map[string]map[string]string
+
+	// the rows of the dimension tables and the start_time of each subsession
+	// fetched, see shared.go
+	dims       map[string]*dimension
+	startTimes map[int]interface{}
+
+	// when each uri was got and the archive of the responses, see archive.go
+	mu        sync.Mutex
+	fetchedAt map[string]time.Time
+	archive   *archive
+
+	stats    stats
+	failures []failure
 }
 
-func NewLeague(ir *irdata.Irdata, leagueId int) *League {
+func NewLeague(ir *irdata.Irdata, leagueIds []int, opts Options) *League {
+	if opts.DataDir == "" {
+		opts.DataDir = defaultDataDir
+	}
+
+	if opts.CacheDir == "" {
+		opts.CacheDir = defaultCacheDir
+	}
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = defaultConcurrency
+	}
+
+	if opts.RequestsPerMinute < 1 {
+		opts.RequestsPerMinute = defaultRequestsPerMinute
+	}
+
 	return &League{
-		leagueId: leagueId,
-		ir:       ir,
+		leagueIds: leagueIds,
+		ir:        ir,
+		opts:      opts,
+		limiter:   rate.NewLimiter(rate.Every(time.Minute/time.Duration(opts.RequestsPerMinute)), opts.Concurrency),
+		seen:      map[string]map[string]string{},
+		dims:      map[string]*dimension{},
+		fetchedAt: map[string]time.Time{},
+
+		startTimes: map[int]interface{}{},
 	}
 }
 
-func (l *League) processLeague() {
-	l.ir.EnableCache("data/.ircache")
-	l.ir.SetLogLevel(irdata.LogLevelInfo)
-	l.OpenWriter()
+// get waits for the rate limiter before fetching uri
+func (l *League) get(ctx context.Context, uri string, ttl time.Duration) ([]byte, error) {
+	err := l.limiter.Wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := l.ir.GetWithCache(uri, ttl)
+	if err != nil {
+		return nil, err
+	}
 
-	l.ConvertParquetToJson("league")
-	l.ConvertParquetToJson("roster")
-	l.ConvertParquetToJson("seasons")
-	l.ConvertParquetToJson("sessions")
-	l.ConvertParquetToJson("results")
-	l.ConvertParquetToJson("team-results")
-	l.ConvertParquetToJson("lap_data")
+	l.fetched(uri, ttl, data)
 
-	defer l.CloseWriter()
+	return data, nil
+}
 
-	// read league info
-	data, err := l.ir.GetWithCache(fmt.Sprintf("/data/league/get?league_id=%d", l.leagueId), cacheTTL)
+// fetch gets uri and unmarshals it into v
+func (l *League) fetch(ctx context.Context, uri string, ttl time.Duration, v any) error {
+	data, err := l.get(ctx, uri, ttl)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("%s: %w", uri, err)
 	}
 
-	var rawLeague map[string]interface{}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return fmt.Errorf("%s: %w", uri, err)
+	}
 
-	err = json.Unmarshal(data, &rawLeague)
+	return nil
+}
+
+// processLeagues syncs the leagues into the staging directory and swaps it in
+// if nothing went wrong beyond some leagues, seasons or sessions failing to
+// fetch, see failures.go
+func (l *League) processLeagues() error {
+	err := moveLegacyCache(l.opts.DataDir, l.opts.CacheDir)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	// drop this roster because we'll load that into another parquet
-	delete(rawLeague, "roster")
+	err = l.ir.EnableCache(l.opts.CacheDir)
+	if err != nil {
+		return err
+	}
 
-	l.WriteJson(rawLeague, "league")
+	l.ir.SetLogLevel(irdata.LogLevelInfo)
 
-	// read league roster
-	data, err = l.ir.GetWithCache(fmt.Sprintf("/data/league/roster?league_id=%d", l.leagueId), cacheTTL)
+	err = l.BeginStaging()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	var rawRoster map[string]interface{}
+	err = l.OpenWriter()
+	if err != nil {
+		return err
+	}
 
-	err = json.Unmarshal(data, &rawRoster)
+	err = l.OpenArchive()
 	if err != nil {
-		log.Panic(err)
+		l.CloseWriter()
+		return err
 	}
 
-	l.WriteJson(rawRoster["roster"], "roster")
+	err = l.sync()
+	if err != nil {
+		l.CloseArchive()
+		l.CloseWriter()
+		return err
+	}
 
-	// read league seasons
-	data, err = l.ir.GetWithCache(fmt.Sprintf("/data/league/seasons?league_id=%d&retired=true", l.leagueId), cacheTTL)
+	err = l.CloseArchive()
 	if err != nil {
-		log.Panic(err)
+		l.CloseWriter()
+		return err
 	}
 
-	var rawSeasons map[string]interface{}
+	err = l.CloseWriter()
+	if err != nil {
+		return err
+	}
 
-	err = json.Unmarshal(data, &rawSeasons)
+	validation, err := Validate(l.dir)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("validating: %w", err)
 	}
 
-	l.WriteJson(rawSeasons["seasons"], "seasons")
+	validation.Dir = l.opts.DataDir
 
-	for _, s := range rawSeasons["seasons"].([]interface{}) {
-		s := s.(map[string]interface{})
+	err = validation.write(l.dir)
+	if err != nil {
+		return err
+	}
 
-		l.processSeason(int(s["season_id"].(float64)))
+	err = l.CommitStaging()
+	if err != nil {
+		return err
 	}
 
-	l.MergeJson("sessions-*", "sessions")
-	l.MergeJson("results-*", "results")
-	l.MergeJson("team-results-*", "team-results")
-	l.MergeJson("lap_data-*", "lap_data")
+	l.PrintSummary()
 
-	l.ConvertJsonToParquet("league")
-	l.ConvertJsonToParquet("roster")
-	l.ConvertJsonToParquet("seasons")
-	l.ConvertJsonToParquet("sessions")
-	l.ConvertJsonToParquet("results")
-	l.ConvertJsonToParquet("team-results")
-	l.ConvertJsonToParquet("lap_data")
+	err = validation.print(log.Writer())
+	if err != nil {
+		return err
+	}
+
+	if validation.Errors > 0 {
+		return fmt.Errorf("the dataset failed validation with %d errors, see %s",
+			validation.Errors, filepath.Join(l.opts.DataDir, validationFile))
+	}
+
+	return nil
 }
 
-func (l *League) processSeason(seasonId int) {
-	data, err := l.ir.GetWithCache(
-		fmt.Sprintf("/data/league/season_sessions?league_id=%d&season_id=%d",
-			l.leagueId, seasonId), cacheTTL)
+func (l *League) sync() error {
+	err := l.OpenManifest()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	var rawSessions map[string]interface{}
+	err = l.MigrateLegacyTables()
+	if err != nil {
+		return err
+	}
+
+	// league.duckdb has to be reloaded from the parquet files once they've
+	// been written without it
+	if s, ok := l.store.(*duckStore); ok {
+		s.stale, err = l.StoreStale(l.storeName())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range slices.Concat(tables, derivedTables) {
+		err = l.store.Load(t)
+		if err != nil {
+			return fmt.Errorf("loading %s: %w", t, err)
+		}
+	}
 
-	err = json.Unmarshal(data, &rawSessions)
+	err = l.MigrateSchemas()
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	l.WriteJson(rawSessions["sessions"], fmt.Sprintf("sessions-%d", seasonId))
+	for _, leagueId := range l.leagueIds {
+		if !l.wanted(leagueId, 0, 0) {
+			continue
+		}
 
-	for _, s := range rawSessions["sessions"].([]interface{}) {
-		s := s.(map[string]interface{})
+		err = l.processLeague(leagueId)
+		if err != nil {
+			return err
+		}
+	}
 
-		if s["has_results"].(bool) {
-			if s["driver_changes"].(bool) {
-				l.processSession("team-", s)
-			} else {
-				l.processSession("", s)
+	for _, t := range tables {
+		err = l.store.Merge(t)
+		if err != nil {
+			return fmt.Errorf("merging %s: %w", t, err)
+		}
+
+		err = l.store.Save(t)
+		if err != nil {
+			return fmt.Errorf("saving %s: %w", t, err)
+		}
+	}
+
+	err = l.processShared()
+	if err != nil {
+		return err
+	}
+
+	err = l.processTeams()
+	if err != nil {
+		return err
+	}
+
+	err = l.processRosterHistory()
+	if err != nil {
+		return err
+	}
+
+	err = l.processSchedule()
+	if err != nil {
+		return err
+	}
+
+	err = l.CreateViews()
+	if err != nil {
+		return err
+	}
+
+	l.ReportSchemaDrift()
+
+	err = l.WriteFailures()
+	if err != nil {
+		return err
+	}
+
+	err = l.RecordStore(l.storeName())
+	if err != nil {
+		return err
+	}
+
+	return l.CommitManifest()
+}
+
+// processLeague syncs a league.  Failing to fetch it, or any of its seasons or
+// sessions, is recorded and skipped; only failing to write is an error.
+func (l *League) processLeague(leagueId int) error {
+	var rawLeague, rawRoster, rawSeasons map[string]interface{}
+
+	ctx := context.Background()
+
+	var (
+		leagueUri  = fmt.Sprintf("/data/league/get?league_id=%d", leagueId)
+		rosterUri  = fmt.Sprintf("/data/league/roster?league_id=%d", leagueId)
+		seasonsUri = fmt.Sprintf("/data/league/seasons?league_id=%d&retired=true", leagueId)
+	)
+
+	// everything is fetched before anything is written so that a league is
+	// never half written
+	err := l.fetch(ctx, leagueUri, cacheTTL, &rawLeague)
+	if err == nil {
+		err = l.fetch(ctx, rosterUri, cacheTTL, &rawRoster)
+	}
+
+	if err == nil {
+		err = l.fetch(ctx, seasonsUri, cacheTTL, &rawSeasons)
+	}
+
+	var seasons []map[string]interface{}
+
+	if err == nil {
+		seasons, err = objects(rawSeasons, "seasons")
+	}
+
+	if err != nil {
+		l.fail(leagueId, 0, 0, err)
+		return nil
+	}
+
+	// drop this roster because we'll load that into another parquet
+	delete(rawLeague, "roster")
+
+	setColumn(rawRoster["roster"], "league_id", leagueId)
+	setColumn(rawSeasons["seasons"], "league_id", leagueId)
+
+	l.setSource(rawLeague, leagueUri)
+	l.setSource(rawRoster["roster"], rosterUri)
+	l.setSource(rawSeasons["seasons"], seasonsUri)
+
+	for _, t := range []struct {
+		table string
+		data  any
+	}{
+		{"league", rawLeague},
+		{"roster", rawRoster["roster"]},
+		{"seasons", rawSeasons["seasons"]},
+	} {
+		if !l.fetches(t.table) {
+			continue
+		}
+
+		err = l.store.Clear(t.table, leagueId)
+		if err != nil {
+			return fmt.Errorf("clearing %s: %w", t.table, err)
+		}
+
+		err = l.write(t.data, t.table, strconv.Itoa(leagueId))
+		if err != nil {
+			return err
+		}
+
+		err = l.store.Merge(t.table)
+		if err != nil {
+			return fmt.Errorf("merging %s: %w", t.table, err)
+		}
+	}
+
+	if l.fetches("points_systems") {
+		err = l.processPointsSystems(leagueId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, s := range seasons {
+		seasonId, err := number(s, "season_id")
+		if err != nil {
+			l.fail(leagueId, 0, 0, err)
+			continue
+		}
+
+		active, err := boolean(s, "active")
+		if err != nil {
+			l.fail(leagueId, seasonId, 0, err)
+			continue
+		}
+
+		if !l.wanted(leagueId, seasonId, 0) {
+			continue
+		}
+
+		retired := !active
+
+		// nothing new is going to show up in a retired season
+		if retired {
+			synced, err := l.SeasonSynced(seasonId)
+			if err != nil {
+				return err
+			}
+
+			if synced {
+				log.Printf("Skipping retired season %d [%s]", seasonId, s["season_name"])
+				l.stats.skippedSeasons++
+				continue
 			}
 		}
+
+		err = l.processSeason(leagueId, seasonId, retired)
+		if err != nil {
+			return err
+		}
 	}
 
-	l.MergeJson("sessions-*", "sessions")
-	l.MergeJson("results-*", "results")
-	l.MergeJson("team-results-*", "team-results")
+	l.stats.leagues++
+
+	return l.RecordLeague(leagueId)
 }
 
-func (l *League) processSession(sessionPrefix string, session map[string]interface{}) {
-	subsessionId := int(session["subsession_id"].(float64))
+// processPointsSystems syncs the points systems of a league.  They aren't
+// needed for the rest of the league, so failing to fetch them is recorded and
+// the ones synced before, if any, are kept.
+func (l *League) processPointsSystems(leagueId int) error {
+	var rawPointsSystems map[string]interface{}
+
+	pointsSystemsUri := fmt.Sprintf("/data/league/get_points_systems?league_id=%d", leagueId)
 
-	if l.SessionExists(sessionPrefix, subsessionId) {
-		return
+	err := l.fetch(context.Background(), pointsSystemsUri, cacheTTL, &rawPointsSystems)
+	if err != nil {
+		l.fail(leagueId, 0, 0, err)
+		return nil
 	}
 
-	data, err := l.ir.GetWithCache(fmt.Sprintf("/data/results/get?subsession_id=%d", subsessionId), resultCacheTTL)
+	setColumn(rawPointsSystems["points_systems"], "league_id", leagueId)
+	l.setSource(rawPointsSystems["points_systems"], pointsSystemsUri)
+
+	err = l.store.Clear("points_systems", leagueId)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("clearing points_systems: %w", err)
 	}
 
-	var subsession map[string]interface{}
+	err = l.write(rawPointsSystems["points_systems"], "points_systems", strconv.Itoa(leagueId))
+	if err != nil {
+		return err
+	}
 
-	err = json.Unmarshal(data, &subsession)
+	err = l.store.Merge("points_systems")
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("merging points_systems: %w", err)
 	}
 
-	for _, s := range subsession["session_results"].([]interface{}) {
-		s := s.(map[string]interface{})
+	return nil
+}
 
-		s["subsession_id"] = subsessionId
-		simsessionNumber := int(s["simsession_number"].(float64))
+func (l *League) processSeason(leagueId int, seasonId int, retired bool) error {
+	var rawSessions map[string]interface{}
 
-		for _, r := range s["results"].([]interface{}) {
-			r := r.(map[string]interface{})
+	uri := fmt.Sprintf("/data/league/season_sessions?league_id=%d&season_id=%d", leagueId, seasonId)
 
-			var lapDataParams string
-			var lapperId int
+	err := l.fetch(context.Background(), uri, cacheTTL, &rawSessions)
 
-			if sessionPrefix == "" {
-				lapperId = int(r["cust_id"].(float64))
-				lapDataParams = fmt.Sprintf("cust_id=%d", lapperId)
-			} else {
-				lapperId = int(r["team_id"].(float64))
-				lapDataParams = fmt.Sprintf("team_id=%d", lapperId)
-			}
+	var sessions []map[string]interface{}
+
+	if err == nil {
+		sessions, err = objects(rawSessions, "sessions")
+	}
+
+	if err != nil {
+		l.fail(leagueId, seasonId, 0, err)
+		return nil
+	}
+
+	setColumn(rawSessions["sessions"], "league_id", leagueId)
+	setColumn(rawSessions["sessions"], "season_id", seasonId)
+	l.setSource(rawSessions["sessions"], uri)
+
+	if l.fetches("sessions") {
+		err = l.write(rawSessions["sessions"], "sessions", strconv.Itoa(seasonId))
+		if err != nil {
+			return err
+		}
+	}
+
+	complete := true
+
+	for i, s := range sessions {
+		var subsessionId int
+		var driverChanges bool
+
+		hasResults, err := boolean(s, "has_results")
+		if err == nil && hasResults {
+			subsessionId, err = number(s, "subsession_id")
+		}
+
+		if err == nil && hasResults {
+			driverChanges, err = boolean(s, "driver_changes")
+		}
+
+		if err != nil {
+			l.fail(leagueId, seasonId, subsessionId, fmt.Errorf("session %d: %w", i, err))
+			complete = false
+			continue
+		}
+
+		if !hasResults {
+			continue
+		}
 
-			data, err = l.ir.GetWithCache(fmt.Sprintf("/data/results/lap_data?subsession_id=%d&simsession_number=%d&%s",
-				subsessionId, simsessionNumber, lapDataParams), resultCacheTTL)
+		synced := false
+
+		if l.wanted(leagueId, seasonId, subsessionId) {
+			synced, err = l.processSession(leagueId, seasonId, subsessionId, driverChanges)
+		} else {
+			synced, err = l.SessionSynced(subsessionId)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		complete = complete && synced
+	}
+
+	for _, t := range []string{"sessions", "results", "team-results", "event_log"} {
+		err = l.store.Merge(t)
+		if err != nil {
+			return fmt.Errorf("merging %s: %w", t, err)
+		}
+	}
+
+	l.stats.seasons++
+
+	return l.RecordSeason(leagueId, seasonId, retired, complete)
+}
+
+// processSession syncs what is missing of a subsession and reports whether it
+// is synced, which it isn't when it failed to fetch
+func (l *League) processSession(leagueId int, seasonId int, subsessionId int, driverChanges bool) (bool, error) {
+	sessionPrefix := ""
+	if driverChanges {
+		sessionPrefix = "team-"
+	}
+
+	state, err := l.SessionState(subsessionId)
+	if err != nil {
+		return false, err
+	}
+
+	if !state.results {
+		// synced by a version of league_db that predates the manifest
+		legacy, err := l.store.SessionExists(sessionPrefix+"results", subsessionId)
+		if err != nil {
+			return false, err
+		}
+
+		if legacy {
+			state = state.or(sessionState{results: true, lapData: true})
+
+			err = l.RecordSession(leagueId, seasonId, subsessionId, driverChanges, state)
 			if err != nil {
-				log.Panic(err)
+				return false, err
 			}
+		}
+	}
 
-			var laps map[string]interface{}
+	missing := l.missing(state)
 
-			err = json.Unmarshal(data, &laps)
-			if err != nil {
-				log.Panic(err)
+	if missing == (sessionState{}) {
+		l.stats.skippedSessions++
+		return true, nil
+	}
+
+	simsessions, requests, err := l.fetchSession(subsessionId, driverChanges)
+
+	var allLaps []map[string]interface{}
+	var events [][]interface{}
+
+	if err == nil && missing.lapData {
+		allLaps, err = l.FetchLapData(requests)
+	}
+
+	if err == nil && missing.eventLog {
+		events, err = l.FetchEventLogs(subsessionId, simsessions)
+	}
+
+	if err != nil {
+		l.fail(leagueId, seasonId, subsessionId, err)
+		return false, nil
+	}
+
+	for j, s := range simsessions {
+		simsessionNumber, _ := number(s, "simsession_number")
+
+		var lapData []map[string]interface{}
+		var lappers []int
+
+		for i, req := range requests {
+			if !missing.lapData || req.simsessionNumber != simsessionNumber {
+				continue
 			}
 
+			laps := allLaps[i]
+
+			laps["league_id"] = leagueId
+			laps["season_id"] = seasonId
 			laps["events"] = laps["_chunk_data"]
 
+			// the driver or team the laps were requested for, which keys them
+			if driverChanges {
+				laps["group_id"] = req.lapperId
+			} else {
+				laps["cust_id"] = req.lapperId
+			}
+
 			delete(laps, "chunk_info")
 			delete(laps, "_chunk_data")
 
-			l.WriteJson(laps, fmt.Sprintf("lap_data-%d_%d_%d", subsessionId, simsessionNumber, lapperId))
+			lapData = append(lapData, laps)
+			lappers = append(lappers, req.lapperId)
+		}
+
+		decodeLaps(simsessionNumber, lapData)
+
+		for i, laps := range lapData {
+			err = l.write(laps, "lap_data", fmt.Sprintf("%d_%d_%d", subsessionId, simsessionNumber, lappers[i]))
+			if err != nil {
+				return false, err
+			}
 		}
 
-		l.WriteJson(s, fmt.Sprintf("%sresults-%d_%d", sessionPrefix, subsessionId, simsessionNumber))
+		if missing.results {
+			s["league_id"] = leagueId
+			s["season_id"] = seasonId
+			s["subsession_id"] = subsessionId
 
-		l.MergeJson("lap_data-*", "lap_data")
+			err = l.write(s, sessionPrefix+"results", fmt.Sprintf("%d_%d", subsessionId, simsessionNumber))
+			if err != nil {
+				return false, err
+			}
+		}
+
+		if missing.eventLog {
+			err = l.writeEventLog(leagueId, seasonId, subsessionId, simsessionNumber, events[j])
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	l.stats.sessions++
+
+	return true, l.RecordSession(leagueId, seasonId, subsessionId, driverChanges, state.or(missing))
+}
+
+// missing returns what is left to sync of a subsession in state, leaving out
+// the tables that aren't being fetched
+func (l *League) missing(state sessionState) sessionState {
+	return sessionState{
+		results:  !state.results && (l.fetches("results") || l.fetches("team-results")),
+		lapData:  !state.lapData && l.fetches("lap_data"),
+		eventLog: !state.eventLog && l.fetches("event_log"),
+	}
+}
+
+// fetches reports whether table is being fetched, see Options.Tables
+func (l *League) fetches(table string) bool {
+	return len(l.opts.Tables) == 0 || slices.Contains(l.opts.Tables, table)
+}
+
+// fetchSession fetches the results of a subsession and works out the lap data
+// requests for everybody (or every team) in each of its simsessions
+func (l *League) fetchSession(subsessionId int, driverChanges bool) ([]map[string]interface{}, []lapDataRequest, error) {
+	var subsession map[string]interface{}
+
+	uri := fmt.Sprintf("/data/results/get?subsession_id=%d", subsessionId)
+
+	err := l.fetch(context.Background(), uri, resultCacheTTL, &subsession)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	setColumn(subsession["session_results"], "race_week_num", subsession["race_week_num"])
+	setColumn(subsession["session_results"], "start_time", subsession["start_time"])
+
+	l.startTimes[subsessionId] = subsession["start_time"]
+
+	l.setSource(subsession["session_results"], uri)
+
+	simsessions, err := objects(subsession, "session_results")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var requests []lapDataRequest
+
+	for _, s := range simsessions {
+		simsessionNumber, err := number(s, "simsession_number")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		results, err := objects(s, "results")
+		if err != nil {
+			return nil, nil, fmt.Errorf("simsession %d: %w", simsessionNumber, err)
+		}
+
+		for _, r := range results {
+			lapper := "cust_id"
+			if driverChanges {
+				lapper = "team_id"
+			}
+
+			lapperId, err := number(r, lapper)
+			if err != nil {
+				return nil, nil, fmt.Errorf("simsession %d: %w", simsessionNumber, err)
+			}
+
+			requests = append(requests, lapDataRequest{
+				simsessionNumber: simsessionNumber,
+				lapperId:         lapperId,
+				uri: fmt.Sprintf("/data/results/lap_data?subsession_id=%d&simsession_number=%d&%s=%d",
+					subsessionId, simsessionNumber, lapper, lapperId),
+			})
+		}
+	}
+
+	return simsessions, requests, nil
+}
+
+func list(data map[string]interface{}, key string) ([]interface{}, error) {
+	l, ok := data[key].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not a list", key)
+	}
+
+	return l, nil
+}
+
+// objects returns data[key] as a list of objects
+func objects(data map[string]interface{}, key string) ([]map[string]interface{}, error) {
+	l, err := list(data, key)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]map[string]interface{}, len(l))
+
+	for i, o := range l {
+		var ok bool
+
+		objects[i], ok = o.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s[%d] is not an object", key, i)
+		}
+	}
+
+	return objects, nil
+}
+
+func number(data map[string]interface{}, key string) (int, error) {
+	n, ok := data[key].(float64)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a number", key)
+	}
+
+	return int(n), nil
+}
+
+func boolean(data map[string]interface{}, key string) (bool, error) {
+	b, ok := data[key].(bool)
+	if !ok {
+		return false, fmt.Errorf("%s is not a boolean", key)
+	}
+
+	return b, nil
+}
+
+// setColumn sets key to value in a row or in every row of a list of rows
+func setColumn(data interface{}, key string, value interface{}) {
+	switch d := data.(type) {
+	case map[string]interface{}:
+		d[key] = value
+	case []interface{}:
+		for _, r := range d {
+			setColumn(r, key, value)
+		}
 	}
 }
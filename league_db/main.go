@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/popmonkey/irdata"
 )
@@ -17,22 +23,170 @@ import (
 4.   Get Results [/data/league/season_sessions?league_id=&season	_id=]
 */
 
+const toolName = "league_db"
+
+// errUsage is returned by a command that was run with the wrong arguments
+var errUsage = errors.New("usage")
+
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(fs *flag.FlagSet, args []string) error
+}
+
+var commands = []command{
+	{"sync", "[options] <keyfile> <credsfile> [<league id>...]", "fetch leagues into the dataset", syncCommand},
+	{"status", "[options]", "show what is synced and when", statusCommand},
+	{"export", "[options] [<table>...]", "write tables to CSV, JSON, parquet or a DuckDB database", exportCommand},
+	{"query", "[options] [<sql>]", "run SQL, read from stdin when not given, against the dataset", queryCommand},
+	{"validate", "[options]", "check the dataset for missing and duplicate rows", validateCommand},
+	{"rollback", "[options]", "restore the dataset replaced by the last sync", rollbackCommand},
+}
+
+func usage() {
+	w := flag.CommandLine.Output()
+
+	fmt.Fprintf(w, "Usage: %s <command> [options] [arguments]\n\nCommands:\n", toolName)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+	}
+
+	fmt.Fprintf(w, "\nRun %s <command> -h for the options of a command.  Without a command, %s\n"+
+		"syncs as it always has.\n", toolName, toolName)
+}
+
 func main() {
-	var err error
+	args := os.Args[1:]
+
+	// league_db used to only sync so anything but a command is taken to be
+	// the arguments of sync
+	c := commands[0]
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "-h", "-help", "--help", "help":
+			usage()
+			return
+		}
+
+		for _, cmd := range commands {
+			if cmd.name == args[0] {
+				c = cmd
+				args = args[1:]
+				break
+			}
+		}
+	}
+
+	fs := flag.NewFlagSet(fmt.Sprintf("%s %s", toolName, c.name), flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", toolName, c.name, c.args)
+		fs.PrintDefaults()
+	}
 
-	if len(os.Args) != 4 {
-		fmt.Println("Usage: stats <keyfile> <credsfile> <league id>")
-		os.Exit(1)
+	err := c.run(fs, args)
+	if err == errUsage {
+		fs.Usage()
+		os.Exit(2)
 	}
 
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// dirFlag adds the option that every command has for the data directory
+func dirFlag(fs *flag.FlagSet, dir *string) {
+	fs.StringVar(dir, "dir", defaultDataDir, "the directory the dataset is kept in")
+}
+
+func syncCommand(fs *flag.FlagSet, args []string) error {
 	var (
-		keyFile   = os.Args[1]
-		credsFile = os.Args[2]
+		opts        Options
+		leaguesFile string
+		retryFile   string
+		tableList   string
 	)
 
-	leagueId, err := strconv.Atoi(os.Args[3])
-	if err != nil {
-		log.Panic(err)
+	dirFlag(fs, &opts.DataDir)
+	fs.StringVar(&opts.CacheDir, "cache", defaultCacheDir, "the directory API responses are cached in")
+	fs.StringVar(&tableList, "tables", "", "comma separated tables to fetch, of "+strings.Join(tables, ", ")+" (default all)")
+	fs.StringVar(&leaguesFile, "leagues", "", "file with the ids of the leagues to sync, one per line")
+	fs.IntVar(&opts.Concurrency, "concurrency", defaultConcurrency, "maximum number of lap data requests in flight")
+	fs.IntVar(&opts.RequestsPerMinute, "rate", defaultRequestsPerMinute, "maximum number of API requests per minute")
+	fs.BoolVar(&opts.DuckDB, "duckdb", false, "keep the tables in <dir>/"+duckDBFile+" and export them to parquet")
+	fs.BoolVar(&opts.Archive, "archive", false, "keep the API responses in <dir>/"+archiveDir+" as compressed NDJSON")
+	fs.StringVar(&retryFile, "retry", "", "only sync what failed according to this file, e.g. <dir>/"+failuresFile)
+
+	fs.Parse(args)
+
+	args = fs.Args()
+
+	if len(args) < 2 || opts.Concurrency < 1 || opts.RequestsPerMinute < 1 {
+		return errUsage
+	}
+
+	opts.DataDir = filepath.Clean(opts.DataDir)
+
+	if tableList != "" {
+		for _, t := range strings.Split(tableList, ",") {
+			t = strings.TrimSpace(t)
+
+			if !slices.Contains(tables, t) {
+				return fmt.Errorf("not a table: %s", t)
+			}
+
+			opts.Tables = append(opts.Tables, t)
+		}
+	}
+
+	var (
+		keyFile   = args[0]
+		credsFile = args[1]
+		leagueIds []int
+	)
+
+	for _, id := range args[2:] {
+		leagueId, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("not a valid id: %v", id)
+		}
+
+		leagueIds = append(leagueIds, leagueId)
+	}
+
+	if leaguesFile != "" {
+		ids, err := readLeagueIds(leaguesFile)
+		if err != nil {
+			return err
+		}
+
+		leagueIds = append(leagueIds, ids...)
+	}
+
+	if retryFile != "" {
+		var err error
+
+		opts.Retry, err = ReadFailures(retryFile)
+		if err != nil {
+			return err
+		}
+
+		if len(opts.Retry) == 0 {
+			log.Printf("Nothing to retry in %s", retryFile)
+			return nil
+		}
+
+		for _, f := range opts.Retry {
+			if !slices.Contains(leagueIds, f.LeagueId) {
+				leagueIds = append(leagueIds, f.LeagueId)
+			}
+		}
+	}
+
+	if len(leagueIds) == 0 {
+		return errUsage
 	}
 
 	var credsProvider irdata.CredsFromTerminal
@@ -40,7 +194,7 @@ func main() {
 	ir := irdata.Open(context.Background())
 	ir.SetLogLevel(irdata.LogLevelError)
 
-	_, err = os.Stat(credsFile)
+	_, err := os.Stat(credsFile)
 	if err != nil {
 		err = ir.AuthAndSaveProvidedCredsToFile(keyFile, credsFile, credsProvider)
 	} else {
@@ -48,12 +202,56 @@ func main() {
 	}
 
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	ir.EnableCache(".cache")
+	l := NewLeague(ir, leagueIds, opts)
+
+	return l.processLeagues()
+}
 
-	l := NewLeague(ir, leagueId)
+func rollbackCommand(fs *flag.FlagSet, args []string) error {
+	var dir string
+
+	dirFlag(fs, &dir)
+
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	return Rollback(filepath.Clean(dir))
+}
+
+// readLeagueIds reads league ids from a file with one id per line.  Blank lines
+// and anything following a # are ignored.
+func readLeagueIds(fn string) ([]int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var leagueIds []int
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			continue
+		}
+
+		leagueId, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a valid id: %v", fn, line)
+		}
+
+		leagueIds = append(leagueIds, leagueId)
+	}
 
-	l.processLeague()
+	return leagueIds, scanner.Err()
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// The sync manifest is a small persistent DuckDB database that records which
+// leagues, seasons and subsessions have been synced and when.  Subsessions that
+// are complete are never fetched again and retired seasons that are complete
+// are skipped without even looking at their sessions.  It also records when
+// each API response was fetched, see archive.go, and when the dataset was last
+// synced with and without -duckdb so that league.duckdb is never trusted after
+// the parquet files have moved on without it.
+
+const manifestFile = "manifest.duckdb"
+
+var manifestTables = []struct {
+	name    string
+	columns string
+}{
+	{"leagues", `
+		league_id INTEGER PRIMARY KEY,
+		synced_at TIMESTAMP`},
+	{"seasons", `
+		league_id INTEGER,
+		season_id INTEGER PRIMARY KEY,
+		retired BOOLEAN,
+		complete BOOLEAN,
+		synced_at TIMESTAMP`},
+	{"sessions", `
+		league_id INTEGER,
+		season_id INTEGER,
+		subsession_id BIGINT PRIMARY KEY,
+		driver_changes BOOLEAN,
+		results_complete BOOLEAN,
+		lap_data_complete BOOLEAN,
+		team_results_complete BOOLEAN,
+		event_log_complete BOOLEAN,
+		synced_at TIMESTAMP`},
+	{"schemas", `
+		table_name VARCHAR PRIMARY KEY,
+		version INTEGER,
+		migrated_at TIMESTAMP`},
+	{"responses", `
+		uri VARCHAR PRIMARY KEY,
+		body_hash VARCHAR,
+		fetched_at TIMESTAMP,
+		expires_at TIMESTAMP`},
+	{"stores", `
+		store VARCHAR PRIMARY KEY,
+		synced_at TIMESTAMP`},
+}
+
+// manifestMigrations bring manifests written by earlier versions of league_db
+// up to date.  Sessions synced before event logs were have theirs fetched on
+// the next sync.
+var manifestMigrations = []string{
+	"ALTER TABLE manifest.sessions ADD COLUMN IF NOT EXISTS event_log_complete BOOLEAN",
+}
+
+func (l *League) OpenManifest() error {
+	_, err := l.db.ExecContext(context.Background(), fmt.Sprintf("ATTACH '%s/%s' AS manifest", l.dir, manifestFile))
+	if err != nil {
+		return err
+	}
+
+	for _, t := range manifestTables {
+		// updates are staged in pending_* until CommitManifest so that the
+		// manifest never claims data that didn't make it into the parquet files
+		for _, sql := range []string{
+			fmt.Sprintf("CREATE TABLE IF NOT EXISTS manifest.%s (%s)", t.name, t.columns),
+			fmt.Sprintf("CREATE TEMP TABLE pending_%s (%s)", t.name, t.columns),
+		} {
+			_, err = l.db.ExecContext(context.Background(), sql)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, sql := range manifestMigrations {
+		_, err = l.db.ExecContext(context.Background(), sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (l *League) CommitManifest() error {
+	for _, t := range manifestTables {
+		sql := fmt.Sprintf("INSERT OR REPLACE INTO manifest.%s BY NAME SELECT * FROM pending_%s", t.name, t.name)
+
+		_, err := l.db.ExecContext(context.Background(), sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SeasonSynced reports whether a season is complete, which it isn't while any
+// of its sessions are missing something, e.g. the event logs that earlier
+// versions of league_db didn't fetch or the tables left out with -tables
+func (l *League) SeasonSynced(seasonId int) (bool, error) {
+	var complete bool
+
+	err := l.db.QueryRowContext(context.Background(), `
+		SELECT EXISTS (FROM manifest.seasons WHERE season_id=? AND complete)
+			AND NOT EXISTS (
+				FROM manifest.sessions
+				WHERE season_id=?
+					AND (results_complete AND lap_data_complete AND team_results_complete AND event_log_complete) IS NOT TRUE
+			)`,
+		seasonId, seasonId).Scan(&complete)
+
+	return complete, err
+}
+
+// sessionState is what has been synced of a subsession
+type sessionState struct {
+	results  bool
+	lapData  bool
+	eventLog bool
+}
+
+func (s sessionState) or(o sessionState) sessionState {
+	return sessionState{s.results || o.results, s.lapData || o.lapData, s.eventLog || o.eventLog}
+}
+
+// SessionState returns what has been synced of a subsession, which is nothing
+// for one that isn't in the manifest
+func (l *League) SessionState(subsessionId int) (sessionState, error) {
+	var state sessionState
+
+	err := l.db.QueryRowContext(context.Background(), `
+		SELECT
+			coalesce(results_complete AND team_results_complete, false),
+			coalesce(lap_data_complete, false),
+			coalesce(event_log_complete, false)
+		FROM manifest.sessions
+		WHERE subsession_id=?`, subsessionId).Scan(&state.results, &state.lapData, &state.eventLog)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+
+	return state, err
+}
+
+// SessionSynced reports whether everything that is being fetched of a
+// subsession has been synced
+func (l *League) SessionSynced(subsessionId int) (bool, error) {
+	state, err := l.SessionState(subsessionId)
+
+	return l.missing(state) == sessionState{}, err
+}
+
+func (l *League) RecordLeague(leagueId int) error {
+	_, err := l.db.ExecContext(context.Background(),
+		"INSERT OR REPLACE INTO pending_leagues VALUES (?, now())", leagueId)
+
+	return err
+}
+
+func (l *League) RecordSeason(leagueId int, seasonId int, retired bool, complete bool) error {
+	_, err := l.db.ExecContext(context.Background(),
+		"INSERT OR REPLACE INTO pending_seasons VALUES (?, ?, ?, ?, now())",
+		leagueId, seasonId, retired, complete)
+
+	return err
+}
+
+// RecordSession notes the state of a subsession.  Sessions without driver
+// changes have no team results so those are always considered complete.
+func (l *League) RecordSession(leagueId int, seasonId int, subsessionId int, driverChanges bool, state sessionState) error {
+	_, err := l.db.ExecContext(context.Background(),
+		"INSERT OR REPLACE INTO pending_sessions VALUES (?, ?, ?, ?, ?, ?, ?, ?, now())",
+		leagueId, seasonId, subsessionId, driverChanges,
+		state.results,
+		state.lapData,
+		state.results || !driverChanges,
+		state.eventLog)
+
+	return err
+}
+
+// RecordStore notes that the dataset was synced with store, see StoreStale
+func (l *League) RecordStore(store string) error {
+	_, err := l.db.ExecContext(context.Background(),
+		"INSERT OR REPLACE INTO pending_stores VALUES (?, now())", store)
+
+	return err
+}
+
+// StoreStale reports whether the tables kept by store may be older than the
+// parquet files, which they are when the dataset has been synced with another
+// store since, or store has never been recorded as it wasn't before there were
+// stores in the manifest
+func (l *League) StoreStale(store string) (bool, error) {
+	var stale bool
+
+	err := l.db.QueryRowContext(context.Background(), `
+		SELECT coalesce(
+			(SELECT synced_at FROM manifest.stores WHERE store=?)
+				< (SELECT max(synced_at) FROM manifest.stores WHERE store<>?),
+			NOT EXISTS (FROM manifest.stores WHERE store=?))`,
+		store, store, store).Scan(&stale)
+
+	return stale, err
+}
+
+// ResponseFetchedAt returns when the response to uri with a body hashing to
+// bodyHash was fetched from the API, and when it expires from the cache,
+// unless it wasn't or has expired
+func (l *League) ResponseFetchedAt(uri string, bodyHash string) (time.Time, time.Time, bool, error) {
+	var fetchedAt, expiresAt time.Time
+
+	err := l.db.QueryRowContext(context.Background(), `
+		SELECT fetched_at, expires_at
+		FROM (
+			FROM pending_responses
+			UNION ALL
+			FROM manifest.responses
+		)
+		WHERE uri=? AND body_hash=? AND expires_at > ?
+		ORDER BY fetched_at DESC
+		LIMIT 1`, uri, bodyHash, time.Now().UTC()).Scan(&fetchedAt, &expiresAt)
+	if err == sql.ErrNoRows {
+		return fetchedAt, expiresAt, false, nil
+	}
+
+	return fetchedAt, expiresAt, err == nil, err
+}
+
+func (l *League) RecordResponse(uri string, bodyHash string, fetchedAt time.Time, expiresAt time.Time) error {
+	_, err := l.db.ExecContext(context.Background(),
+		"INSERT OR REPLACE INTO pending_responses VALUES (?, ?, ?, ?)",
+		uri, bodyHash, fetchedAt, expiresAt)
+
+	return err
+}
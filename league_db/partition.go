@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sessions, results, lap data and event logs are written as Hive partitioned datasets,
+// <dir>/<table>/league_id=<id>/season_id=<id>/*.parquet, so that syncing a
+// season only rewrites the files of that season and so that readers can skip
+// the seasons they aren't interested in.
+
+var partitioned = map[string]bool{
+	"sessions":     true,
+	"results":      true,
+	"team-results": true,
+	"lap_data":     true,
+	"event_log":    true,
+}
+
+// snapshot tables have all the rows of a partition fetched on every sync so the
+// new rows replace the partition instead of being added to it
+var snapshot = map[string]bool{
+	"sessions": true,
+}
+
+type partition struct {
+	leagueId int64
+	seasonId int64
+}
+
+func partitionPath(dir string, table string, p partition) string {
+	return fmt.Sprintf("%s/%s/league_id=%d/season_id=%d", dir, table, p.leagueId, p.seasonId)
+}
+
+// readPartitions returns SQL that reads the given partitions of table or all of
+// them when there are none given
+func readPartitions(dir string, table string, partitions ...partition) string {
+	if len(partitions) == 0 {
+		return fmt.Sprintf("read_parquet('%s/%s/*/*/*.parquet', hive_partitioning=true, union_by_name=true)", dir, table)
+	}
+
+	files := make([]string, len(partitions))
+	for i, p := range partitions {
+		files[i] = fmt.Sprintf("%s/*.parquet", partitionPath(dir, table, p))
+	}
+
+	return fmt.Sprintf("read_parquet(['%s'], hive_partitioning=true, union_by_name=true)",
+		strings.Join(files, "','"))
+}
+
+// partitionsOf returns the distinct partitions of the rows returned by query
+func partitionsOf(db *sql.DB, query string) ([]partition, error) {
+	rows, err := db.QueryContext(context.Background(),
+		fmt.Sprintf("SELECT DISTINCT league_id, season_id FROM (%s) ORDER BY ALL", query))
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	var partitions []partition
+
+	for rows.Next() {
+		var p partition
+
+		err = rows.Scan(&p.leagueId, &p.seasonId)
+		if err != nil {
+			return nil, err
+		}
+
+		partitions = append(partitions, p)
+	}
+
+	return partitions, rows.Err()
+}
+
+// writePartitions writes the rows returned by query to table replacing every
+// partition they fall into.  Partitions without any rows are left alone.
+func writePartitions(db *sql.DB, dir string, query string, table string) error {
+	tmp := fmt.Sprintf("%s/TMP_%s", dir, table)
+
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(tmp)
+
+	sql := fmt.Sprintf("COPY (%s) TO '%s' (FORMAT PARQUET, PARTITION_BY (league_id, season_id))", query, tmp)
+	_, err = db.ExecContext(context.Background(), sql)
+	if err != nil {
+		return err
+	}
+
+	dirs, err := filepath.Glob(fmt.Sprintf("%s/league_id=*/season_id=*", tmp))
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dirs {
+		rel, err := filepath.Rel(tmp, d)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(dir, table, rel)
+
+		err = os.RemoveAll(dest)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(d, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MigrateLegacyTables splits the single parquet files of the partitioned
+// tables, as written by earlier versions of league_db, into partitions.  The
+// season of every row is looked up in the old sessions file.
+func (l *League) MigrateLegacyTables() error {
+	legacySessions := fmt.Sprintf("%s/sessions.parquet", l.dir)
+
+	exists, err := fileExists(legacySessions)
+	if !exists {
+		return err
+	}
+
+	seasons := fmt.Sprintf(`
+		SELECT DISTINCT subsession_id, league_id, league_season_id AS season_id
+		FROM read_parquet('%s')
+		WHERE subsession_id IS NOT NULL`, legacySessions)
+
+	subsessionIds := map[string]string{
+		"results":      "t.subsession_id",
+		"team-results": "t.subsession_id",
+		"lap_data":     "t.session_info.subsession_id",
+	}
+
+	// sessions has to go last as it's needed to place everything else
+	for _, table := range []string{"results", "team-results", "lap_data", "sessions"} {
+		fn := fmt.Sprintf("%s/%s.parquet", l.dir, table)
+
+		exists, err = fileExists(fn)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			continue
+		}
+
+		log.Printf("Partitioning %s", fn)
+
+		query := fmt.Sprintf(`
+			SELECT t.*, s.league_id, s.season_id
+			FROM (SELECT COLUMNS(c -> c NOT IN ('league_id', 'season_id')) FROM read_parquet('%s')) t
+			JOIN (%s) s ON %s = s.subsession_id`, fn, seasons, subsessionIds[table])
+
+		if table == "sessions" {
+			query = fmt.Sprintf(`
+				SELECT COLUMNS(c -> c NOT IN ('league_id', 'season_id')), league_id, league_season_id AS season_id
+				FROM read_parquet('%s')`, fn)
+		}
+
+		err = writePartitions(l.db, l.dir, query, table)
+		if err != nil {
+			return fmt.Errorf("partitioning %s: %w", fn, err)
+		}
+
+		err = os.Remove(fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The status, export and query commands read the dataset as it was last
+// synced, which is always exported to parquet, through an in-memory DuckDB.
+// Every table is a view named after it, with team-results being team_results,
+// and the analytic views of views.go are created on top of them.
+
+// openDataset opens the dataset in dir with a view for each table in it and
+// returns the tables it has.  It never writes to dir so it's fine to run while
+// a sync is running.
+func openDataset(dir string) (*sql.DB, []string, error) {
+	dir = filepath.Clean(dir)
+
+	exists, err := fileExists(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !exists {
+		return nil, nil, fmt.Errorf("there is no dataset in %s", dir)
+	}
+
+	db, err := sql.Open("duckdb", "")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &jsonStore{db: db, dir: dir}
+
+	var views []string
+
+	for _, table := range slices.Concat(tables, derivedTables) {
+		exists, err := s.Exists(table)
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+
+		if !exists {
+			err = createEmptyTable(db, table)
+		} else {
+			_, err = db.ExecContext(context.Background(),
+				fmt.Sprintf("CREATE VIEW %s AS FROM %s", tableName(table), s.Query(table)))
+			views = append(views, table)
+		}
+
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+
+	err = createViews(db)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return db, views, nil
+}
+
+var formats = []string{"table", "csv", "json"}
+
+// printRows writes rows to w as an aligned table, CSV or JSON lines
+func printRows(w io.Writer, rows *sql.Rows, format string) error {
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	values := make([]any, len(names))
+	pointers := make([]any, len(names))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	var tw *tabwriter.Writer
+	var cw *csv.Writer
+	var jw *json.Encoder
+
+	switch format {
+	case "table":
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(names, "\t")))
+	case "csv":
+		cw = csv.NewWriter(w)
+		err = cw.Write(names)
+	case "json":
+		jw = json.NewEncoder(w)
+	default:
+		return fmt.Errorf("not a format: %s", format)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for rows.Next() {
+		err = rows.Scan(pointers...)
+		if err != nil {
+			return err
+		}
+
+		switch format {
+		case "table":
+			fields := make([]string, len(values))
+			for i, v := range values {
+				fields[i] = formatValue(v)
+			}
+
+			_, err = fmt.Fprintln(tw, strings.Join(fields, "\t"))
+		case "csv":
+			fields := make([]string, len(values))
+			for i, v := range values {
+				fields[i] = formatValue(v)
+			}
+
+			err = cw.Write(fields)
+		case "json":
+			row := make(map[string]any, len(names))
+			for i, name := range names {
+				row[name] = values[i]
+			}
+
+			err = jw.Encode(row)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "table":
+		return tw.Flush()
+	case "csv":
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return nil
+}
+
+// formatValue formats a column value for a table or CSV, with NULLs left
+// empty and nested values as JSON
+func formatValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.DateTime)
+	case map[string]any, []any:
+		data, err := json.Marshal(v)
+		if err == nil {
+			return string(data)
+		}
+	}
+
+	return fmt.Sprint(v)
+}
+
+func queryCommand(fs *flag.FlagSet, args []string) error {
+	var dir, format string
+	var list bool
+
+	dirFlag(fs, &dir)
+	fs.StringVar(&format, "format", "table", "output format, one of "+strings.Join(formats, ", "))
+	fs.BoolVar(&list, "list", false, "list the tables and views that can be queried")
+
+	fs.Parse(args)
+
+	if fs.NArg() > 1 || (list && fs.NArg() > 0) {
+		return errUsage
+	}
+
+	if list {
+		db, views, err := openDataset(dir)
+		if err != nil {
+			return err
+		}
+
+		db.Close()
+
+		fmt.Print(viewList(views))
+
+		return nil
+	}
+
+	query := fs.Arg(0)
+
+	if query == "" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		query = string(data)
+	}
+
+	db, _, err := openDataset(dir)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	rows, err := db.QueryContext(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	return printRows(os.Stdout, rows, format)
+}
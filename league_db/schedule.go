@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+)
+
+// season_sessions has every session of a season, whether it has been run or
+// not, and seasons the points system of every season.  So that standings and
+// calendars can be worked out from the dataset alone, the schedule table has a
+// row per scheduled session, numbered in the order they launch and with the
+// weather they are set up with unpacked, and the season_points_systems table a
+// row per season with its points system and drop rules.  Both are derived from
+// the others at the end of a sync.
+
+var scheduleTables = []string{
+	"schedule",
+	"season_points_systems",
+}
+
+// scheduleQueries are the SQL that derives each of scheduleTables from
+// sessions, in %[1]s, seasons, in %[2]s, and points_systems, in %[3]s
+var scheduleQueries = map[string]string{
+	"schedule": `
+		SELECT
+			s.league_id,
+			s.season_id,
+			row_number() OVER (PARTITION BY s.league_id, s.season_id ORDER BY s.launch_at, s.session_id) AS session_number,
+			s.session_id,
+			s.subsession_id,
+			s.launch_at,
+			s.status,
+			s.has_results,
+			s.track_id,
+			s.driver_changes,
+			s.lone_qualify,
+			s.practice_length,
+			s.qualify_length,
+			s.qualify_laps,
+			s.race_length,
+			s.race_laps,
+			s.time_limit,
+			TRY_CAST(s.weather->>'type' AS BIGINT) AS weather_type,
+			TRY_CAST(s.weather->>'temp_units' AS BIGINT) AS temp_units,
+			TRY_CAST(s.weather->>'temp_value' AS DOUBLE) AS temp_value,
+			TRY_CAST(s.weather->>'rel_humidity' AS BIGINT) AS rel_humidity,
+			TRY_CAST(s.weather->>'fog' AS BIGINT) AS fog,
+			TRY_CAST(s.weather->>'skies' AS BIGINT) AS skies,
+			TRY_CAST(s.weather->>'wind_dir' AS BIGINT) AS wind_dir,
+			TRY_CAST(s.weather->>'wind_units' AS BIGINT) AS wind_units,
+			TRY_CAST(s.weather->>'wind_value' AS DOUBLE) AS wind_value,
+			TRY_CAST(s.weather->>'weather_var_initial' AS BIGINT) AS weather_var_initial,
+			TRY_CAST(s.weather->>'weather_var_ongoing' AS BIGINT) AS weather_var_ongoing,
+			TRY_CAST(s.weather->>'time_of_day' AS BIGINT) AS time_of_day,
+			s.weather->>'simulated_start_time' AS simulated_start_time,
+			s.weather,
+			s.track_state
+		FROM %[1]s s
+		ORDER BY s.league_id, s.season_id, session_number`,
+
+	"season_points_systems": `
+		SELECT
+			se.league_id,
+			se.season_id,
+			se.season_name,
+			se.points_system_id,
+			coalesce(p.name, se.points_system_name) AS points_system_name,
+			coalesce(p.description, se.points_system_desc) AS points_system_desc,
+			p.retired,
+			p.iracing_system,
+			se.num_drops,
+			se.no_drops_on_or_after_race_num,
+			se.points_cars,
+			se.driver_points_car_classes,
+			se.team_points_car_classes
+		FROM %[2]s se
+		LEFT JOIN %[3]s p ON p.league_id = se.league_id AND p.points_system_id = se.points_system_id
+		ORDER BY se.league_id, se.season_id`,
+}
+
+// scheduleSources are the tables each of scheduleTables can't be derived
+// without.  Seasons whose points systems were never synced, e.g. because they
+// couldn't be fetched, have the name and description seasons gives them.
+var scheduleSources = map[string][]string{
+	"schedule":              {"sessions"},
+	"season_points_systems": {"seasons"},
+}
+
+// processSchedule derives the schedule tables, unless what they are derived
+// from was never synced
+func (l *League) processSchedule() error {
+	for _, table := range scheduleTables {
+		synced := true
+
+		for _, source := range scheduleSources[table] {
+			exists, err := l.store.Exists(source)
+			if err != nil {
+				return err
+			}
+
+			synced = synced && exists
+		}
+
+		if !synced {
+			continue
+		}
+
+		pointsSystems := l.store.Query("points_systems")
+
+		exists, err := l.store.Exists("points_systems")
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			pointsSystems = emptyQuery("points_systems")
+		}
+
+		query := fmt.Sprintf(scheduleQueries[table], l.store.Query("sessions"), l.store.Query("seasons"), pointsSystems)
+
+		err = l.store.Derive(table, query)
+		if err != nil {
+			return fmt.Errorf("deriving %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,881 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Every table league_db fetches has an explicit, versioned schema.  Rows are
+// coerced into it when they are written so that a change in what iRacing
+// returns can't change the type of a column between runs.  Fields that aren't
+// in the schema are dropped and fields that are missing are NULL; both are
+// reported at the end of a sync so that the schema can be updated.
+//
+// Bumping the version of a schema migrates the existing data of its table to
+// the new schema on the next sync.  Nested objects that nothing looks inside of
+// (liveries, weather and the like) are kept as JSON so they can't drift at all.
+
+// field is a column or a field of a STRUCT column.  Fields with fields of their
+// own are STRUCTs, or lists of STRUCTs when list is set.
+type field struct {
+	name   string
+	typ    string
+	list   bool
+	fields []field
+}
+
+type schema struct {
+	version int
+	fields  []field
+}
+
+// upgrade reads the rows of a table, in %s, written with a version of its
+// schema before version in a way that can be coerced into that version.
+// Fields that are gone don't need one as the coercion drops them.
+type upgrade struct {
+	version int
+	sql     string
+}
+
+var upgrades = map[string][]upgrade{
+	// tracks were replaced by their id and names, see shared.go
+	"sessions": {{2, `SELECT * EXCLUDE (track), track.track_id AS track_id, track.track_name AS track_name,
+		track.config_name AS config_name FROM %s`}},
+	"lap_data": {
+		{2, "SELECT * REPLACE (struct_insert(session_info, track_id := session_info.track.track_id) AS session_info) FROM %s"},
+		// laps were decoded from lap_events rather than flags before version 6
+		{6, decodeLapsQuery()},
+		// the laps of teams have had the team they were requested for as their
+		// group_id, which keys them, since version 7
+		{7, `SELECT * REPLACE (
+			coalesce(nullif(regexp_extract(source_uri, '[?&]team_id=(-?[0-9]+)', 1), '')::BIGINT, group_id) AS group_id)
+			FROM %s`},
+	},
+}
+
+// upgradeQuery returns the SQL that reads the rows of table, written with
+// version of its schema, from query
+func upgradeQuery(table string, version int, query string) string {
+	query = fmt.Sprintf("SELECT * FROM %s", query)
+
+	for _, u := range upgrades[table] {
+		if u.version > version {
+			query = fmt.Sprintf(u.sql, "("+query+")")
+		}
+	}
+
+	return query
+}
+
+func col(name string, typ string) field {
+	return field{name: name, typ: typ}
+}
+
+func structCol(name string, fields ...field) field {
+	return field{name: name, fields: fields}
+}
+
+func listCol(name string, fields ...field) field {
+	return field{name: name, list: true, fields: fields}
+}
+
+// duckType returns the DuckDB type of f
+func (f field) duckType() string {
+	if f.fields == nil {
+		return f.typ
+	}
+
+	fields := make([]string, len(f.fields))
+	for i, ff := range f.fields {
+		fields[i] = fmt.Sprintf(`"%s" %s`, ff.name, ff.duckType())
+	}
+
+	typ := fmt.Sprintf("STRUCT(%s)", strings.Join(fields, ", "))
+	if f.list {
+		typ += "[]"
+	}
+
+	return typ
+}
+
+// columns returns the column definitions of s for CREATE TABLE
+func (s schema) columns() string {
+	columns := make([]string, len(s.fields))
+	for i, f := range s.fields {
+		columns[i] = fmt.Sprintf(`"%s" %s`, f.name, f.duckType())
+	}
+
+	return strings.Join(columns, ", ")
+}
+
+// readJson returns SQL that reads files as rows of table coerced into its schema
+func readJson(table string, files ...string) string {
+	s := schemas[table]
+
+	columns := make([]string, len(s.fields))
+	for i, f := range s.fields {
+		columns[i] = fmt.Sprintf("'%s': '%s'", f.name, f.duckType())
+	}
+
+	return fmt.Sprintf("read_json(['%s'], columns={%s})",
+		strings.Join(files, "','"), strings.Join(columns, ", "))
+}
+
+// jsonType returns the structure of f for from_json
+func (f field) jsonType() string {
+	if f.fields == nil {
+		return fmt.Sprintf(`"%s"`, f.typ)
+	}
+
+	fields := make([]string, len(f.fields))
+	for i, ff := range f.fields {
+		fields[i] = fmt.Sprintf(`"%s": %s`, ff.name, ff.jsonType())
+	}
+
+	typ := fmt.Sprintf("{%s}", strings.Join(fields, ", "))
+	if f.list {
+		typ = "[" + typ + "]"
+	}
+
+	return typ
+}
+
+// fromJson returns SQL that reads rows of table, passed as a JSON list in the
+// parameter of a prepared statement, coerced into its schema
+func fromJson(table string) string {
+	return fmt.Sprintf("SELECT unnest(r) FROM (SELECT unnest(from_json(?, '%s')) AS r)",
+		listCol(table, schemas[table].fields...).jsonType())
+}
+
+// emptyQuery returns SQL that reads no rows with the columns of table, for
+// joining with a table that may never have been synced
+func emptyQuery(table string) string {
+	s := schemas[table]
+
+	columns := make([]string, len(s.fields))
+	for i, f := range s.fields {
+		columns[i] = fmt.Sprintf(`NULL::%s AS "%s"`, f.duckType(), f.name)
+	}
+
+	return fmt.Sprintf("(SELECT %s LIMIT 0)", strings.Join(columns, ", "))
+}
+
+var track = []field{
+	col("track_id", "BIGINT"),
+	col("track_name", "VARCHAR"),
+	col("config_name", "VARCHAR"),
+}
+
+// resultFields are the fields that driver and team results have in common,
+// with the names of the car and class raced, see shared.go
+var resultFields = []field{
+	col("finish_position", "BIGINT"),
+	col("finish_position_in_class", "BIGINT"),
+	col("laps_lead", "BIGINT"),
+	col("laps_complete", "BIGINT"),
+	col("opt_laps_complete", "BIGINT"),
+	col("interval", "BIGINT"),
+	col("class_interval", "BIGINT"),
+	col("average_lap", "BIGINT"),
+	col("best_lap_num", "BIGINT"),
+	col("best_lap_time", "BIGINT"),
+	col("best_nlaps_num", "BIGINT"),
+	col("best_nlaps_time", "BIGINT"),
+	col("best_qual_lap_at", "TIMESTAMP"),
+	col("best_qual_lap_num", "BIGINT"),
+	col("best_qual_lap_time", "BIGINT"),
+	col("reason_out_id", "BIGINT"),
+	col("reason_out", "VARCHAR"),
+	col("champ_points", "BIGINT"),
+	col("drop_race", "BOOLEAN"),
+	col("club_points", "BIGINT"),
+	col("position", "BIGINT"),
+	col("qual_lap_time", "BIGINT"),
+	col("starting_position", "BIGINT"),
+	col("starting_position_in_class", "BIGINT"),
+	col("car_class_id", "BIGINT"),
+	col("car_class_name", "VARCHAR"),
+	col("car_class_short_name", "VARCHAR"),
+	col("incidents", "BIGINT"),
+	col("max_pct_fuel_fill", "BIGINT"),
+	col("weight_penalty_kg", "BIGINT"),
+	col("league_points", "BIGINT"),
+	col("league_agg_points", "BIGINT"),
+	col("car_id", "BIGINT"),
+	col("car_name", "VARCHAR"),
+	col("aggregate_champ_points", "BIGINT"),
+	col("livery", "JSON"),
+	col("ai", "BOOLEAN"),
+}
+
+var driverFields = concat([]field{
+	col("cust_id", "BIGINT"),
+	col("display_name", "VARCHAR"),
+	col("club_id", "BIGINT"),
+	col("club_name", "VARCHAR"),
+	col("club_shortname", "VARCHAR"),
+	col("division", "BIGINT"),
+	col("division_name", "VARCHAR"),
+	col("country_code", "VARCHAR"),
+	col("old_license_level", "BIGINT"),
+	col("old_sub_level", "BIGINT"),
+	col("old_cpi", "DOUBLE"),
+	col("oldi_rating", "BIGINT"),
+	col("old_ttrating", "BIGINT"),
+	col("new_license_level", "BIGINT"),
+	col("new_sub_level", "BIGINT"),
+	col("new_cpi", "DOUBLE"),
+	col("newi_rating", "BIGINT"),
+	col("new_ttrating", "BIGINT"),
+	col("multiplier", "BIGINT"),
+	col("license_change_oval", "BIGINT"),
+	col("license_change_road", "BIGINT"),
+	col("suit", "JSON"),
+	col("helmet", "JSON"),
+	col("watched", "BOOLEAN"),
+	col("friend", "BOOLEAN"),
+}, resultFields)
+
+var simsessionFields = []field{
+	col("simsession_number", "BIGINT"),
+	col("simsession_name", "VARCHAR"),
+	col("simsession_type", "BIGINT"),
+	col("simsession_type_name", "VARCHAR"),
+	col("simsession_subtype", "BIGINT"),
+	col("weather_result", "JSON"),
+}
+
+// subsessionFields are the fields of a subsession copied onto the rows of each
+// of its simsessions
+var subsessionFields = []field{
+	col("race_week_num", "BIGINT"),
+	col("start_time", "TIMESTAMP"),
+}
+
+var keyFields = []field{
+	col("league_id", "BIGINT"),
+	col("season_id", "BIGINT"),
+	col("subsession_id", "BIGINT"),
+}
+
+// sourceFields are the provenance columns of the fetched tables, see archive.go
+var sourceFields = []field{
+	col("source_uri", "VARCHAR"),
+	col("fetched_at", "TIMESTAMP"),
+}
+
+var schemas = map[string]schema{
+	"league": {2, concat([]field{
+		col("league_id", "BIGINT"),
+		col("league_name", "VARCHAR"),
+		col("owner_id", "BIGINT"),
+		col("owner", "JSON"),
+		col("created", "TIMESTAMP"),
+		col("hidden", "BOOLEAN"),
+		col("message", "VARCHAR"),
+		col("about", "VARCHAR"),
+		col("url", "VARCHAR"),
+		col("rules", "VARCHAR"),
+		col("recruiting", "BOOLEAN"),
+		col("private_wall", "BOOLEAN"),
+		col("private_roster", "BOOLEAN"),
+		col("private_schedule", "BOOLEAN"),
+		col("private_results", "BOOLEAN"),
+		col("is_owner", "BOOLEAN"),
+		col("is_admin", "BOOLEAN"),
+		col("is_member", "BOOLEAN"),
+		col("is_applicant", "BOOLEAN"),
+		col("is_invite", "BOOLEAN"),
+		col("is_ignored", "BOOLEAN"),
+		col("roster_count", "BIGINT"),
+		col("image", "JSON"),
+		col("tags", "JSON"),
+		col("league_applications", "JSON"),
+		col("pending_requests", "JSON"),
+	}, sourceFields)},
+	"roster": {2, concat([]field{
+		col("league_id", "BIGINT"),
+		col("cust_id", "BIGINT"),
+		col("display_name", "VARCHAR"),
+		col("nick_name", "VARCHAR"),
+		col("car_number", "VARCHAR"),
+		col("owner", "BOOLEAN"),
+		col("admin", "BOOLEAN"),
+		col("league_member_since", "TIMESTAMP"),
+		col("league_mail_opt_out", "BOOLEAN"),
+		col("league_pm_opt_out", "BOOLEAN"),
+		col("helmet", "JSON"),
+	}, sourceFields)},
+	"seasons": {2, concat([]field{
+		col("league_id", "BIGINT"),
+		col("season_id", "BIGINT"),
+		col("season_name", "VARCHAR"),
+		col("active", "BOOLEAN"),
+		col("hidden", "BOOLEAN"),
+		col("points_system_id", "BIGINT"),
+		col("points_system_name", "VARCHAR"),
+		col("points_system_desc", "VARCHAR"),
+		col("num_drops", "BIGINT"),
+		col("no_drops_on_or_after_race_num", "BIGINT"),
+		col("points_cars", "JSON"),
+		col("driver_points_car_classes", "JSON"),
+		col("team_points_car_classes", "JSON"),
+	}, sourceFields)},
+	"points_systems": {2, concat([]field{
+		col("league_id", "BIGINT"),
+		col("points_system_id", "BIGINT"),
+		col("name", "VARCHAR"),
+		col("description", "VARCHAR"),
+		col("retired", "BOOLEAN"),
+		col("iracing_system", "BOOLEAN"),
+	}, sourceFields)},
+	"sessions": {4, concat(keyFields, []field{
+		col("league_season_id", "BIGINT"),
+		col("session_id", "BIGINT"),
+		col("private_session_id", "BIGINT"),
+		col("launch_at", "TIMESTAMP"),
+		col("status", "BIGINT"),
+		col("has_results", "BOOLEAN"),
+		col("driver_changes", "BOOLEAN"),
+		col("password_protected", "BOOLEAN"),
+		col("lone_qualify", "BOOLEAN"),
+		col("entry_count", "BIGINT"),
+		col("team_entry_count", "BIGINT"),
+		col("practice_length", "BIGINT"),
+		col("qualify_length", "BIGINT"),
+		col("qualify_laps", "BIGINT"),
+		col("race_length", "BIGINT"),
+		col("race_laps", "BIGINT"),
+		col("time_limit", "BIGINT"),
+		col("pace_car_id", "BIGINT"),
+		col("pace_car_class_id", "BIGINT"),
+		col("winner_id", "BIGINT"),
+		col("track_id", "BIGINT"),
+		col("track_name", "VARCHAR"),
+		col("config_name", "VARCHAR"),
+		listCol("cars",
+			col("car_id", "BIGINT"),
+			col("car_class_id", "BIGINT"),
+			col("max_pct_fuel_fill", "BIGINT"),
+			col("weight_penalty_kg", "BIGINT"),
+			col("power_adjust_pct", "DOUBLE"),
+			col("max_dry_tire_sets", "BIGINT"),
+			col("package_id", "BIGINT"),
+		),
+		col("track_state", "JSON"),
+		col("weather", "JSON"),
+	}, sourceFields)},
+	"results": {6, concat(keyFields, subsessionFields, simsessionFields, []field{
+		listCol("results", driverFields...),
+	}, sourceFields)},
+	"team-results": {6, concat(keyFields, subsessionFields, simsessionFields, []field{
+		listCol("results", concat([]field{
+			col("team_id", "BIGINT"),
+			col("display_name", "VARCHAR"),
+			listCol("driver_results", concat([]field{col("team_id", "BIGINT")}, driverFields)...),
+		}, resultFields)...),
+	}, sourceFields)},
+	"lap_data": {7, concat([]field{
+		col("league_id", "BIGINT"),
+		col("season_id", "BIGINT"),
+		col("success", "BOOLEAN"),
+		structCol("session_info",
+			col("subsession_id", "BIGINT"),
+			col("session_id", "BIGINT"),
+			col("simsession_number", "BIGINT"),
+			col("simsession_type", "BIGINT"),
+			col("simsession_name", "VARCHAR"),
+			col("num_laps_for_qual_average", "BIGINT"),
+			col("num_laps_for_solo_average", "BIGINT"),
+			col("event_type", "BIGINT"),
+			col("event_type_name", "VARCHAR"),
+			col("private_session_id", "BIGINT"),
+			col("season_name", "VARCHAR"),
+			col("season_short_name", "VARCHAR"),
+			col("series_name", "VARCHAR"),
+			col("series_short_name", "VARCHAR"),
+			col("start_time", "TIMESTAMP"),
+			col("track_id", "BIGINT"),
+		),
+		col("cust_id", "BIGINT"),
+		col("team_id", "BIGINT"),
+		col("name", "VARCHAR"),
+		col("group_id", "BIGINT"),
+		col("car_id", "BIGINT"),
+		col("license_level", "BIGINT"),
+		col("best_lap_num", "BIGINT"),
+		col("best_lap_time", "BIGINT"),
+		col("best_nlaps_num", "BIGINT"),
+		col("best_nlaps_time", "BIGINT"),
+		col("best_qual_lap_num", "BIGINT"),
+		col("best_qual_lap_time", "BIGINT"),
+		col("best_qual_lap_at", "TIMESTAMP"),
+		col("last_updated", "TIMESTAMP"),
+		col("livery", "JSON"),
+		listCol("events",
+			col("group_id", "BIGINT"),
+			col("name", "VARCHAR"),
+			col("cust_id", "BIGINT"),
+			col("display_name", "VARCHAR"),
+			col("lap_number", "BIGINT"),
+			col("flags", "BIGINT"),
+			col("incident", "BOOLEAN"),
+			col("session_time", "BIGINT"),
+			col("session_start_time", "BIGINT"),
+			col("lap_time", "BIGINT"),
+			col("team_fastest_lap", "BOOLEAN"),
+			col("personal_best_lap", "BOOLEAN"),
+			col("fastest_lap", "BOOLEAN"),
+			col("license_level", "BIGINT"),
+			col("car_number", "VARCHAR"),
+			col("lap_events", "VARCHAR[]"),
+			col("lap_position", "BIGINT"),
+			col("interval", "BIGINT"),
+			col("interval_units", "VARCHAR"),
+			col("ai", "BOOLEAN"),
+
+			// decoded by league_db, see decodeLaps
+			col("lap_seconds", "DOUBLE"),
+			col("pitted", "BOOLEAN"),
+			col("off_track", "BOOLEAN"),
+			col("lost_control", "BOOLEAN"),
+			col("contact", "BOOLEAN"),
+			col("car_contact", "BOOLEAN"),
+			col("invalid", "BOOLEAN"),
+			col("black_flag", "BOOLEAN"),
+			col("car_reset", "BOOLEAN"),
+			col("tow", "BOOLEAN"),
+			col("discontinuity", "BOOLEAN"),
+			col("interpolated_crossing", "BOOLEAN"),
+			col("clock_smash", "BOOLEAN"),
+			col("is_clean_lap", "BOOLEAN"),
+			col("running_position", "BIGINT"),
+			col("gap_to_leader_seconds", "DOUBLE"),
+		),
+	}, sourceFields)},
+	"event_log": {4, concat(keyFields, []field{
+		col("simsession_number", "BIGINT"),
+		col("session_time", "BIGINT"),
+		col("event_seq", "BIGINT"),
+		col("event_code", "BIGINT"),
+		col("group_id", "BIGINT"),
+		col("cust_id", "BIGINT"),
+		col("display_name", "VARCHAR"),
+		col("lap_number", "BIGINT"),
+		col("description", "VARCHAR"),
+		col("message", "VARCHAR"),
+	}, sourceFields)},
+
+	// the dimension tables, see shared.go, which are keyed by their first field
+	"drivers": {2, []field{
+		col("cust_id", "BIGINT"),
+		col("display_name", "VARCHAR"),
+		col("seen_at", "TIMESTAMP"),
+	}},
+	"tracks": {2, concat(track, []field{col("seen_at", "TIMESTAMP")})},
+	"cars": {2, []field{
+		col("car_id", "BIGINT"),
+		col("car_name", "VARCHAR"),
+		col("seen_at", "TIMESTAMP"),
+	}},
+	"car_classes": {2, []field{
+		col("car_class_id", "BIGINT"),
+		col("car_class_name", "VARCHAR"),
+		col("car_class_short_name", "VARCHAR"),
+		col("seen_at", "TIMESTAMP"),
+	}},
+
+	// the team tables, see teams.go
+	"team_driver_results": {2, concat(keyFields, simsessionFields, []field{
+		col("team_id", "BIGINT"),
+	}, driverFields)},
+	"stints": {1, concat(keyFields, []field{
+		col("simsession_number", "BIGINT"),
+		col("team_id", "BIGINT"),
+		col("stint", "BIGINT"),
+		col("cust_id", "BIGINT"),
+		col("first_lap", "BIGINT"),
+		col("last_lap", "BIGINT"),
+		col("laps", "BIGINT"),
+		col("clean_laps", "BIGINT"),
+		col("best_lap_seconds", "DOUBLE"),
+		col("average_lap_seconds", "DOUBLE"),
+		col("average_clean_lap_seconds", "DOUBLE"),
+		col("incident_laps", "BIGINT"),
+		col("pitted_laps", "BIGINT"),
+	})},
+
+	// the schedule tables, see schedule.go
+	"schedule": {1, []field{
+		col("league_id", "BIGINT"),
+		col("season_id", "BIGINT"),
+		col("session_number", "BIGINT"),
+		col("session_id", "BIGINT"),
+		col("subsession_id", "BIGINT"),
+		col("launch_at", "TIMESTAMP"),
+		col("status", "BIGINT"),
+		col("has_results", "BOOLEAN"),
+		col("track_id", "BIGINT"),
+		col("driver_changes", "BOOLEAN"),
+		col("lone_qualify", "BOOLEAN"),
+		col("practice_length", "BIGINT"),
+		col("qualify_length", "BIGINT"),
+		col("qualify_laps", "BIGINT"),
+		col("race_length", "BIGINT"),
+		col("race_laps", "BIGINT"),
+		col("time_limit", "BIGINT"),
+		col("weather_type", "BIGINT"),
+		col("temp_units", "BIGINT"),
+		col("temp_value", "DOUBLE"),
+		col("rel_humidity", "BIGINT"),
+		col("fog", "BIGINT"),
+		col("skies", "BIGINT"),
+		col("wind_dir", "BIGINT"),
+		col("wind_units", "BIGINT"),
+		col("wind_value", "DOUBLE"),
+		col("weather_var_initial", "BIGINT"),
+		col("weather_var_ongoing", "BIGINT"),
+		col("time_of_day", "BIGINT"),
+		col("simulated_start_time", "VARCHAR"),
+		col("weather", "JSON"),
+		col("track_state", "JSON"),
+	}},
+	"season_points_systems": {1, []field{
+		col("league_id", "BIGINT"),
+		col("season_id", "BIGINT"),
+		col("season_name", "VARCHAR"),
+		col("points_system_id", "BIGINT"),
+		col("points_system_name", "VARCHAR"),
+		col("points_system_desc", "VARCHAR"),
+		col("retired", "BOOLEAN"),
+		col("iracing_system", "BOOLEAN"),
+		col("num_drops", "BIGINT"),
+		col("no_drops_on_or_after_race_num", "BIGINT"),
+		col("points_cars", "JSON"),
+		col("driver_points_car_classes", "JSON"),
+		col("team_points_car_classes", "JSON"),
+	}},
+
+	// see history.go
+	"roster_history": {1, []field{
+		col("league_id", "BIGINT"),
+		col("cust_id", "BIGINT"),
+		col("nick_name", "VARCHAR"),
+		col("admin", "BOOLEAN"),
+		col("owner", "BOOLEAN"),
+		col("league_member_since", "TIMESTAMP"),
+		col("valid_from", "TIMESTAMP"),
+		col("valid_to", "TIMESTAMP"),
+		col("last_seen", "TIMESTAMP"),
+	}},
+}
+
+// primaryKeys are the columns, or expressions, that identify the rows of each
+// table.  Rows written to a table replace those with the same key, so that
+// syncing a session again doesn't duplicate it, and validate.go checks that no
+// two rows of a table have the same key.
+var primaryKeys = map[string][]string{
+	"league":                {"league_id"},
+	"roster":                {"league_id", "cust_id"},
+	"seasons":               {"league_id", "season_id"},
+	"points_systems":        {"league_id", "points_system_id"},
+	"sessions":              {"league_id", "season_id", "session_id"},
+	"results":               {"subsession_id", "simsession_number"},
+	"team-results":          {"subsession_id", "simsession_number"},
+	"lap_data":              {"session_info.subsession_id", "session_info.simsession_number", "cust_id", "group_id"},
+	"event_log":             {"subsession_id", "simsession_number", "cust_id", "group_id", "session_time", "event_seq"},
+	"drivers":               {"cust_id"},
+	"tracks":                {"track_id"},
+	"cars":                  {"car_id"},
+	"car_classes":           {"car_class_id"},
+	"team_driver_results":   {"subsession_id", "simsession_number", "team_id", "cust_id"},
+	"stints":                {"subsession_id", "simsession_number", "team_id", "stint"},
+	"schedule":              {"league_id", "season_id", "session_id"},
+	"season_points_systems": {"league_id", "season_id"},
+	"roster_history":        {"league_id", "cust_id", "valid_from"},
+}
+
+// upsertQuery returns the SQL that reads the rows of table from sources, in
+// order of precedence, leaving out those with the same primary key as a row of
+// an earlier source
+func upsertQuery(table string, sources ...string) string {
+	selects := make([]string, len(sources))
+	for i, source := range sources {
+		selects[i] = fmt.Sprintf("SELECT *, %d AS upsert_precedence FROM %s", i, source)
+	}
+
+	return fmt.Sprintf(`
+		SELECT * EXCLUDE (upsert_precedence)
+		FROM (%s)
+		QUALIFY row_number() OVER (PARTITION BY %s ORDER BY upsert_precedence) = 1`,
+		strings.Join(selects, " UNION ALL BY NAME "), strings.Join(primaryKeys[table], ", "))
+}
+
+func concat(fields ...[]field) []field {
+	var all []field
+	for _, f := range fields {
+		all = append(all, f...)
+	}
+
+	return all
+}
+
+// MigrateSchemas rewrites the tables whose data was written with an older
+// version of their schema, or before there were schemas at all
+func (l *League) MigrateSchemas() error {
+	for _, table := range tables {
+		s := schemas[table]
+
+		var version int
+
+		err := l.db.QueryRowContext(context.Background(),
+			"SELECT coalesce(max(version), 0) FROM manifest.schemas WHERE table_name=?", table).Scan(&version)
+		if err != nil {
+			return err
+		}
+
+		if version == s.version {
+			continue
+		}
+
+		exists, err := l.store.Exists(table)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			log.Printf("Migrating %s from schema version %d to %d", table, version, s.version)
+
+			err = l.collectLegacyDimensions(table, version)
+			if err != nil {
+				return fmt.Errorf("migrating %s: %w", table, err)
+			}
+
+			err = l.store.Migrate(table, version)
+			if err != nil {
+				return fmt.Errorf("migrating %s: %w", table, err)
+			}
+		}
+
+		_, err = l.db.ExecContext(context.Background(),
+			"INSERT OR REPLACE INTO pending_schemas VALUES (?, ?, now())", table, s.version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write notes the fields of data before writing it to table so that they can
+// be checked against the schema by ReportSchemaDrift.  The names of drivers,
+// tracks, cars and car classes are collected from data first, see normalize.
+func (l *League) write(data any, table string, part string) error {
+	l.normalize(table, data)
+
+	if l.seen[table] == nil {
+		l.seen[table] = map[string]string{}
+	}
+
+	collectFields(data, "", l.seen[table])
+
+	err := l.store.Write(data, table, part)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// collectFields adds the path and kinds of every field in data to seen.  Fields
+// of objects in lists are named <list>[].<field>.
+func collectFields(data any, prefix string, seen map[string]string) {
+	switch d := data.(type) {
+	case map[string]interface{}:
+		for k, v := range d {
+			path := prefix + k
+
+			if v != nil {
+				seen[path] = addKind(seen[path], kindOf(v))
+			} else if _, ok := seen[path]; !ok {
+				seen[path] = ""
+			}
+
+			switch v.(type) {
+			case map[string]interface{}:
+				collectFields(v, path+".", seen)
+			case []interface{}:
+				collectFields(v, path+"[].", seen)
+			}
+		}
+	case []interface{}:
+		for _, r := range d {
+			collectFields(r, prefix, seen)
+		}
+	}
+}
+
+func kindOf(v any) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return "STRUCT"
+	case []interface{}:
+		return "LIST"
+	case string:
+		return "VARCHAR"
+	case bool:
+		return "BOOLEAN"
+	case int:
+		// the ids league_db sets itself, see setColumn
+		return "BIGINT"
+	case float64:
+		if v == float64(int64(v)) {
+			return "BIGINT"
+		}
+
+		return "DOUBLE"
+	}
+
+	return fmt.Sprintf("%T", v)
+}
+
+// addKind adds kind to kinds, the kinds a field was seen with so far separated
+// by "|".  Whole numbers are only BIGINT until the field is seen with a fraction.
+func addKind(kinds string, kind string) string {
+	if kinds == "" {
+		return kind
+	}
+
+	all := strings.Split(kinds, "|")
+
+	if kind == "BIGINT" && slices.Contains(all, "DOUBLE") {
+		return kinds
+	}
+
+	if kind == "DOUBLE" {
+		all = slices.DeleteFunc(all, func(k string) bool { return k == "BIGINT" })
+	}
+
+	if !slices.Contains(all, kind) {
+		all = append(all, kind)
+	}
+
+	slices.Sort(all)
+
+	return strings.Join(all, "|")
+}
+
+// fits reports whether values of kind can be coerced into a column of typ
+// without losing anything: numbers into wider numbers and strings into
+// timestamps, which arrive as ISO 8601 strings
+func fits(kind string, typ string) bool {
+	switch {
+	case kind == typ:
+		return true
+	case kind == "BIGINT" && typ == "DOUBLE":
+		return true
+	case kind == "VARCHAR" && typ == "TIMESTAMP":
+		return true
+	}
+
+	return false
+}
+
+// schemaFields adds the path and kind of every field in fields to known.  The
+// insides of JSON fields aren't known so anything goes there.
+func schemaFields(fields []field, prefix string, known map[string]string) {
+	for _, f := range fields {
+		path := prefix + f.name
+
+		switch {
+		case f.fields != nil && f.list:
+			known[path] = "LIST"
+			schemaFields(f.fields, path+"[].", known)
+		case f.fields != nil:
+			known[path] = "STRUCT"
+			schemaFields(f.fields, path+".", known)
+		case strings.HasSuffix(f.typ, "[]"):
+			known[path] = "LIST"
+		default:
+			known[path] = f.typ
+		}
+	}
+}
+
+// underJson reports whether path is inside a JSON field
+func underJson(path string, known map[string]string) bool {
+	for p, kind := range known {
+		if kind == "JSON" && (strings.HasPrefix(path, p+".") || strings.HasPrefix(path, p+"[].")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parentOf returns the path of the object or list that contains path
+func parentOf(path string) string {
+	i := strings.LastIndex(path, ".")
+	if i < 0 {
+		return ""
+	}
+
+	return strings.TrimSuffix(path[:i], "[]")
+}
+
+// ReportSchemaDrift logs the fields that were fetched during the sync but
+// aren't in the schema of their table, the fields whose values don't fit the
+// schema and the fields of the schema that weren't fetched at all
+func (l *League) ReportSchemaDrift() {
+	for _, table := range tables {
+		seen := l.seen[table]
+		if seen == nil {
+			continue
+		}
+
+		known := map[string]string{}
+		schemaFields(schemas[table].fields, "", known)
+
+		var report []string
+
+		for path, kinds := range seen {
+			expected, ok := known[path]
+
+			switch {
+			case !ok && !underJson(path, known):
+				report = append(report, fmt.Sprintf("new field %s (%s)", path, kinds))
+			case !ok || kinds == "" || expected == "JSON":
+			default:
+				for _, kind := range strings.Split(kinds, "|") {
+					if !fits(kind, expected) {
+						report = append(report, fmt.Sprintf("changed field %s (%s, was %s)", path, kinds, expected))
+						break
+					}
+				}
+			}
+		}
+
+		for path := range known {
+			_, ok := seen[path]
+			_, parentSeen := seen[parentOf(path)]
+
+			// there's no telling what's missing from objects that never showed up
+			if !ok && (parentSeen || parentOf(path) == "") {
+				report = append(report, fmt.Sprintf("missing field %s", path))
+			}
+		}
+
+		if len(report) == 0 {
+			continue
+		}
+
+		sort.Strings(report)
+
+		log.Printf("Schema drift in %s (schema version %d):\n  %s",
+			table, schemas[table].version, strings.Join(report, "\n  "))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestUpsertQuery checks that the rows of the newest source, the first, win
+// over those of older sources with the same primary key
+func TestUpsertQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		table   string
+		columns string
+		sources []string
+		want    []string
+	}{
+		{
+			"newest row per key", "drivers", "cust_id, display_name",
+			[]string{
+				"(1, 'new')",
+				"(1, 'old'), (2, 'old')",
+			},
+			[]string{"1 new", "2 old"},
+		},
+		{
+			"several sources", "drivers", "cust_id, display_name",
+			[]string{
+				"(1, 'newest')",
+				"(1, 'newer'), (2, 'newer')",
+				"(1, 'old'), (2, 'old'), (3, 'old')",
+			},
+			[]string{"1 newest", "2 newer", "3 old"},
+		},
+		{
+			"composite key", "results", "subsession_id, simsession_number, v",
+			[]string{
+				"(10, 0, 'new')",
+				"(10, 0, 'old'), (10, -1, 'old'), (11, 0, 'old')",
+			},
+			[]string{"10 -1 old", "10 0 new", "11 0 old"},
+		},
+		{
+			"keys in one source only", "drivers", "cust_id, display_name",
+			[]string{
+				"(1, 'new'), (2, 'new')",
+				"(3, 'old')",
+			},
+			[]string{"1 new", "2 new", "3 old"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sql.Open("duckdb", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer db.Close()
+
+			sources := make([]string, len(tt.sources))
+
+			for i, values := range tt.sources {
+				sources[i] = fmt.Sprintf("source_%d", i)
+
+				_, err = db.Exec(fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM (VALUES %s) v(%s)",
+					sources[i], values, tt.columns))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			rows, err := db.Query(fmt.Sprintf("SELECT %s FROM (%s) ORDER BY ALL",
+				tt.columns, upsertQuery(tt.table, sources...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer rows.Close()
+
+			var got []string
+
+			for rows.Next() {
+				values := make([]any, len(strings.Split(tt.columns, ",")))
+				pointers := make([]any, len(values))
+
+				for i := range values {
+					pointers[i] = &values[i]
+				}
+
+				err = rows.Scan(pointers...)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got = append(got, strings.TrimSuffix(fmt.Sprintln(values...), "\n"))
+			}
+
+			err = rows.Err()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
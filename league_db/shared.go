@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Drivers, tracks, cars and car classes show up in every league, season and
+// session.  The tables that are fetched refer to them by id and the drivers,
+// tracks, cars and car_classes tables hold a single row for each of them across
+// all the synced leagues, with their current names.  Names change though, so
+// results, lap data and event logs keep the display_name a driver raced under,
+// sessions the names of their track and results those of the car and class
+// raced.
+//
+// Their rows are picked out of everything that is written, see normalize, and
+// are merged into the rows of earlier syncs at the end of a sync.  Each row has
+// the values of the latest session it was seen in, whichever order sessions
+// are fetched in, and seen_at records when that session started so that the
+// rows of later syncs only win when they are newer.  Rosters are as current as
+// it gets so the names from them are seen at the time of the sync.
+
+var dimensionTables = []string{
+	"drivers",
+	"tracks",
+	"cars",
+	"car_classes",
+}
+
+// dimension collects the rows of a dimension table during a sync.  The values
+// seen at the latest time win, older ones only fill in what's missing.
+type dimension struct {
+	rows   map[int]map[string]interface{}
+	seenAt map[int]time.Time
+}
+
+// addDimension adds the fields of table found in data, seen at seenAt, to the
+// row of table with the same id, the first field of table.  Data without a
+// time, seen by an earlier version of league_db, has a zero seenAt.
+func (l *League) addDimension(table string, data map[string]interface{}, seenAt time.Time) {
+	fields := schemas[table].fields
+
+	id, err := number(data, fields[0].name)
+	if err != nil {
+		return
+	}
+
+	d := l.dims[table]
+	if d == nil {
+		d = &dimension{rows: map[int]map[string]interface{}{}, seenAt: map[int]time.Time{}}
+		l.dims[table] = d
+	}
+
+	row := d.rows[id]
+	if row == nil {
+		row = map[string]interface{}{}
+		d.rows[id] = row
+	}
+
+	newer := !seenAt.Before(d.seenAt[id])
+
+	for _, f := range fields {
+		v := data[f.name]
+
+		if v != nil && (row[f.name] == nil || newer) {
+			row[f.name] = v
+		}
+	}
+
+	if newer {
+		d.seenAt[id] = seenAt
+	}
+}
+
+// normalize copies the names of drivers, tracks, cars and car classes in rows
+// about to be written to table into the dimension tables.  The tracks of
+// sessions and lap data are replaced by their id, and their name for sessions,
+// and the cars of sessions are only referred to by id.
+func (l *League) normalize(table string, data any) {
+	for _, row := range rowsOf(data) {
+		seenAt := l.seenAt(table, row)
+
+		switch table {
+		case "roster":
+			l.addDimension("drivers", row, seenAt)
+
+		case "sessions":
+			track, _ := row["track"].(map[string]interface{})
+			if track != nil {
+				l.addDimension("tracks", track, seenAt)
+				row["track_id"] = track["track_id"]
+				row["track_name"] = track["track_name"]
+				row["config_name"] = track["config_name"]
+			}
+
+			delete(row, "track")
+			delete(row, "winner_name")
+
+			for _, car := range rowsOf(row["cars"]) {
+				l.normalizeCar(car, seenAt)
+
+				delete(car, "car_name")
+				delete(car, "car_class_name")
+				delete(car, "car_class_short_name")
+			}
+
+		case "results":
+			for _, r := range rowsOf(row["results"]) {
+				l.normalizeDriver(r, seenAt)
+			}
+
+		case "team-results":
+			for _, t := range rowsOf(row["results"]) {
+				l.normalizeCar(t, seenAt)
+
+				for _, r := range rowsOf(t["driver_results"]) {
+					l.normalizeDriver(r, seenAt)
+				}
+			}
+
+		case "lap_data":
+			info, _ := row["session_info"].(map[string]interface{})
+			if info != nil {
+				track, _ := info["track"].(map[string]interface{})
+				if track != nil {
+					l.addDimension("tracks", track, seenAt)
+					info["track_id"] = track["track_id"]
+				}
+
+				delete(info, "track")
+			}
+
+			for _, e := range rowsOf(row["events"]) {
+				l.addDimension("drivers", e, seenAt)
+			}
+
+		case "event_log":
+			l.addDimension("drivers", row, seenAt)
+		}
+	}
+}
+
+// seenAt returns when the session of row, about to be written to table,
+// started.  Event logs don't say so it's the start_time of the results of their
+// subsession, which are always fetched first.
+func (l *League) seenAt(table string, row map[string]interface{}) time.Time {
+	var at any
+
+	switch table {
+	case "roster":
+		return time.Now()
+
+	case "sessions":
+		at = row["launch_at"]
+
+	case "results", "team-results":
+		at = row["start_time"]
+
+	case "lap_data":
+		info, _ := row["session_info"].(map[string]interface{})
+		if info != nil {
+			at = info["start_time"]
+		}
+
+	case "event_log":
+		subsessionId, err := number(row, "subsession_id")
+		if err == nil {
+			at = l.startTimes[subsessionId]
+		}
+	}
+
+	s, _ := at.(string)
+
+	// as fetched, or as exported to JSON by DuckDB for the legacy dimensions
+	for _, layout := range []string{time.RFC3339, time.DateTime} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+func (l *League) normalizeCar(row map[string]interface{}, seenAt time.Time) {
+	l.addDimension("cars", row, seenAt)
+	l.addDimension("car_classes", row, seenAt)
+}
+
+func (l *League) normalizeDriver(row map[string]interface{}, seenAt time.Time) {
+	l.addDimension("drivers", row, seenAt)
+	l.normalizeCar(row, seenAt)
+}
+
+// rowsOf returns data, a row or a list of rows, as a list of rows
+func rowsOf(data any) []map[string]interface{} {
+	switch d := data.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{d}
+	case []interface{}:
+		var rows []map[string]interface{}
+
+		for _, r := range d {
+			if r, ok := r.(map[string]interface{}); ok {
+				rows = append(rows, r)
+			}
+		}
+
+		return rows
+	}
+
+	return nil
+}
+
+// processShared writes the dimension tables, the values collected during the
+// sync replacing those of earlier syncs
+func (l *League) processShared() error {
+	for _, table := range dimensionTables {
+		err := l.writeDimension(table)
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
+
+func (l *League) writeDimension(table string) error {
+	d := l.dims[table]
+	if d == nil {
+		return nil
+	}
+
+	rows := make([]map[string]interface{}, 0, len(d.rows))
+	for id, row := range d.rows {
+		if !d.seenAt[id].IsZero() {
+			row["seen_at"] = d.seenAt[id].UTC().Format(time.RFC3339Nano)
+		}
+
+		rows = append(rows, row)
+	}
+
+	fields := schemas[table].fields
+	key := fields[0].name
+
+	sort.Slice(rows, func(i, j int) bool {
+		a, _ := number(rows[i], key)
+		b, _ := number(rows[j], key)
+		return a < b
+	})
+
+	tmp, err := writeTmpJson(rows, table)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	query := fmt.Sprintf("SELECT * FROM %s", readJson(table, tmp))
+
+	exists, err := l.store.Exists(table)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		// the values seen later win and fields that weren't seen during this
+		// sync keep their earlier values.  Rows without a seen_at, written
+		// before there was one, lose to any that have one.
+		var columns []string
+		for _, f := range fields[1:] {
+			if f.name != "seen_at" {
+				columns = append(columns, fmt.Sprintf(
+					"CASE WHEN coalesce(o.seen_at > n.seen_at, o.seen_at IS NOT NULL) THEN coalesce(o.%s, n.%s) ELSE coalesce(n.%s, o.%s) END AS %s",
+					f.name, f.name, f.name, f.name, f.name))
+			}
+		}
+
+		query = fmt.Sprintf(`
+			SELECT %s, %s, greatest(n.seen_at, o.seen_at) AS seen_at
+			FROM (%s) n
+			FULL OUTER JOIN (FROM %s UNION ALL BY NAME FROM %s) o USING (%s)
+			ORDER BY %s`, key, strings.Join(columns, ", "), query, emptyQuery(table), l.store.Query(table), key, key)
+	}
+
+	return l.store.Derive(table, query)
+}
+
+// legacyDimensions are the queries that get the rows of the dimension tables
+// out of tables written with a version of their schema before the one the names
+// were moved out of them in
+var legacyDimensions = map[string]upgrade{
+	"sessions":     {2, "SELECT launch_at, track, cars FROM %s"},
+	"results":      {2, "SELECT results FROM %s"},
+	"team-results": {2, "SELECT results FROM %s"},
+	"event_log":    {2, "SELECT cust_id, display_name FROM %s"},
+}
+
+// collectLegacyDimensions adds the rows of the dimension tables that can be
+// found in table, as written with version of its schema by earlier versions of
+// league_db, to the ones collected during the sync.  Called before the table is
+// migrated.
+func (l *League) collectLegacyDimensions(table string, version int) error {
+	legacy, ok := legacyDimensions[table]
+	if !ok || version >= legacy.version {
+		return nil
+	}
+
+	tmp := fmt.Sprintf("%s/TMP_%s_dimensions.json", l.dir, tableName(table))
+
+	_, err := l.db.ExecContext(context.Background(),
+		fmt.Sprintf("COPY (%s) TO '%s' (FORMAT JSON, ARRAY true)", fmt.Sprintf(legacy.sql, l.store.Query(table)), tmp))
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
+
+	data, err := os.ReadFile(tmp)
+	if err != nil {
+		return err
+	}
+
+	var rows []interface{}
+
+	err = json.Unmarshal(data, &rows)
+	if err != nil {
+		return err
+	}
+
+	l.normalize(table, rows)
+
+	return nil
+}
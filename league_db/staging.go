@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A sync never touches the data directory (data/ by default) itself.  It
+// builds the new dataset in data.staging/, starting from a copy of data/, and
+// only swaps it in once everything has been written.  The dataset it replaces
+// is kept in data.previous/ so that it can be restored with the rollback
+// command, which moves data/ out of the way to data.rollback/ while it swaps
+// the two.  Either swap is finished, or undone, by the next command that runs
+// if it was interrupted.
+
+const (
+	defaultDataDir = "data"
+
+	// the API cache lives outside of the dataset so that it isn't copied
+	// around with it
+	defaultCacheDir = ".ircache"
+)
+
+func stagingDirOf(dataDir string) string {
+	return dataDir + ".staging"
+}
+
+func previousDirOf(dataDir string) string {
+	return dataDir + ".previous"
+}
+
+func rollbackDirOf(dataDir string) string {
+	return dataDir + ".rollback"
+}
+
+// legacyCacheDir is where earlier versions of league_db kept the API cache
+func legacyCacheDirOf(dataDir string) string {
+	return filepath.Join(dataDir, ".ircache")
+}
+
+// BeginStaging prepares a fresh staging directory for the sync to write to.
+// Parquet files and archives are hard linked rather than copied, which is safe
+// since they are always replaced, or left alone, and never written to in place.
+func (l *League) BeginStaging() error {
+	dataDir := l.opts.DataDir
+	stagingDir := stagingDirOf(dataDir)
+
+	err := recoverStaging(dataDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(stagingDir)
+	if err != nil {
+		return err
+	}
+
+	l.dir = stagingDir
+
+	exists, err := fileExists(dataDir)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return os.MkdirAll(stagingDir, 0755)
+	}
+
+	return filepath.WalkDir(dataDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dataDir, path)
+		if err != nil {
+			return err
+		}
+
+		dest := filepath.Join(stagingDir, rel)
+
+		switch {
+		case path == legacyCacheDirOf(dataDir):
+			return filepath.SkipDir
+		case d.IsDir():
+			return os.MkdirAll(dest, 0755)
+		case strings.HasSuffix(path, ".parquet"), strings.HasSuffix(path, archiveSuffix):
+			return os.Link(path, dest)
+		default:
+			return copyFile(path, dest)
+		}
+	})
+}
+
+// CommitStaging swaps the staging directory in for data/.  It must only be
+// called once everything, including the manifest, has been written and closed.
+func (l *League) CommitStaging() error {
+	dataDir := l.opts.DataDir
+	previousDir := previousDirOf(dataDir)
+
+	err := os.RemoveAll(previousDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(dataDir, previousDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.Rename(l.dir, dataDir)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Synced to %s, the previous dataset is in %s", dataDir, previousDir)
+
+	return nil
+}
+
+// Rollback swaps data/ and data.previous/ so that running it again undoes it
+func Rollback(dataDir string) error {
+	previousDir := previousDirOf(dataDir)
+	rollbackDir := rollbackDirOf(dataDir)
+
+	err := recoverStaging(dataDir)
+	if err != nil {
+		return err
+	}
+
+	exists, err := fileExists(previousDir)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return fmt.Errorf("there is no %s to roll back to", previousDir)
+	}
+
+	for _, r := range [][2]string{
+		{dataDir, rollbackDir},
+		{previousDir, dataDir},
+		{rollbackDir, previousDir},
+	} {
+		err = os.Rename(r[0], r[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rolled %s back, the dataset it replaced is in %s", dataDir, previousDir)
+
+	return nil
+}
+
+// recoverStaging finishes a rollback that was interrupted, and restores
+// data.previous/ when a sync was interrupted after data/ had been moved out of
+// the way
+func recoverStaging(dataDir string) error {
+	previousDir := previousDirOf(dataDir)
+	rollbackDir := rollbackDirOf(dataDir)
+
+	dataExists, err := fileExists(dataDir)
+	if err != nil {
+		return err
+	}
+
+	previousExists, err := fileExists(previousDir)
+	if err != nil {
+		return err
+	}
+
+	rollbackExists, err := fileExists(rollbackDir)
+	if err != nil {
+		return err
+	}
+
+	if rollbackExists {
+		// data/ was moved to data.rollback/, the rest of the rollback is
+		// moving data.previous/ to data/ and data.rollback/ to data.previous/
+		if dataExists && previousExists {
+			return fmt.Errorf("%s, %s and %s all exist, move one of them out of the way", dataDir, previousDir, rollbackDir)
+		}
+
+		log.Printf("Finishing the rollback of %s", dataDir)
+
+		if !dataExists {
+			err = os.Rename(previousDir, dataDir)
+			if err != nil {
+				return err
+			}
+		}
+
+		return os.Rename(rollbackDir, previousDir)
+	}
+
+	if dataExists || !previousExists {
+		return nil
+	}
+
+	log.Printf("Restoring %s from %s", dataDir, previousDir)
+
+	return os.Rename(previousDir, dataDir)
+}
+
+// moveLegacyCache moves the API cache out of data/ where earlier versions of
+// league_db kept it
+func moveLegacyCache(dataDir string, cacheDir string) error {
+	legacyCacheDir := legacyCacheDirOf(dataDir)
+
+	exists, err := fileExists(legacyCacheDir)
+	if !exists {
+		return err
+	}
+
+	exists, err = fileExists(cacheDir)
+	if exists || err != nil {
+		return err
+	}
+
+	return os.Rename(legacyCacheDir, cacheDir)
+}
+
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRecoverRollback interrupts a rollback after each of its renames and
+// checks that recovering finishes it without losing either dataset
+func TestRecoverRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		renames  int
+		data     string
+		previous string
+	}{
+		{"not started", 0, "current", "previous"},
+		{"data moved out of the way", 1, "previous", "current"},
+		{"previous moved to data", 2, "previous", "current"},
+		{"finished", 3, "previous", "current"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataDir := filepath.Join(t.TempDir(), "data")
+
+			writeDataset(t, dataDir, "current")
+			writeDataset(t, previousDirOf(dataDir), "previous")
+
+			renames := [][2]string{
+				{dataDir, rollbackDirOf(dataDir)},
+				{previousDirOf(dataDir), dataDir},
+				{rollbackDirOf(dataDir), previousDirOf(dataDir)},
+			}
+
+			for _, r := range renames[:tt.renames] {
+				err := os.Rename(r[0], r[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := recoverStaging(dataDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a sync starting now must not remove either dataset
+			err = os.RemoveAll(stagingDirOf(dataDir))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readDataset(t, dataDir); got != tt.data {
+				t.Errorf("data is %q, want %q", got, tt.data)
+			}
+
+			if got := readDataset(t, previousDirOf(dataDir)); got != tt.previous {
+				t.Errorf("previous is %q, want %q", got, tt.previous)
+			}
+
+			exists, err := fileExists(rollbackDirOf(dataDir))
+			if err != nil || exists {
+				t.Errorf("rollback dir left behind: %v", err)
+			}
+		})
+	}
+}
+
+// writeDataset makes dir a dataset that can be told apart by its name
+func writeDataset(t *testing.T, dir string, name string) {
+	t.Helper()
+
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, "name"), []byte(name), 0644)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readDataset(t *testing.T, dir string) string {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join(dir, "name"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// The status command shows what the manifest says is synced, a line per league
+// or per season, along with the names from the dataset.
+
+func statusCommand(fs *flag.FlagSet, args []string) error {
+	var dir, format string
+	var seasons bool
+
+	dirFlag(fs, &dir)
+	fs.BoolVar(&seasons, "seasons", false, "show every season rather than every league")
+	fs.StringVar(&format, "format", "table", "output format, one of "+strings.Join(formats, ", "))
+
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return errUsage
+	}
+
+	db, views, err := openDataset(dir)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close()
+
+	_, err = db.ExecContext(context.Background(),
+		fmt.Sprintf("ATTACH '%s' AS manifest (READ_ONLY)", filepath.Join(dir, manifestFile)))
+	if err != nil {
+		return err
+	}
+
+	// manifests from before event logs don't have them until the next sync
+	eventLogs := "event_log_complete"
+
+	names, _, err := columns(db, "manifest.sessions")
+	if err != nil {
+		return err
+	}
+
+	if !containsFold(names, eventLogs) {
+		eventLogs = "false"
+	}
+
+	query := statusQuery(seasons, eventLogs, slices.Contains(views, "league"), slices.Contains(views, "seasons"))
+
+	rows, err := db.QueryContext(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	err = printRows(os.Stdout, rows, format)
+	if err != nil {
+		return err
+	}
+
+	if format != "table" {
+		return nil
+	}
+
+	failures, err := fileExists(filepath.Join(dir, failuresFile))
+	if err != nil {
+		return err
+	}
+
+	if failures {
+		fmt.Printf("\nSome of the last sync failed, retry it with %s sync -retry %s\n",
+			toolName, filepath.Join(dir, failuresFile))
+	}
+
+	return nil
+}
+
+// statusQuery returns the SQL for the status of every league, or every season,
+// in the manifest.  The names come from the league and seasons tables if the
+// dataset has them.
+func statusQuery(seasons bool, eventLogs string, hasLeague bool, hasSeasons bool) string {
+	groupBy := "league_id"
+	if seasons {
+		groupBy = "league_id, season_id"
+	}
+
+	sessionCounts := fmt.Sprintf(`
+		SELECT
+			%s,
+			count(*) AS sessions,
+			count(*) FILTER (WHERE results_complete AND team_results_complete) AS results,
+			count(*) FILTER (WHERE lap_data_complete) AS lap_data,
+			count(*) FILTER (WHERE %s) AS event_logs
+		FROM manifest.sessions
+		GROUP BY ALL`, groupBy, eventLogs)
+
+	if seasons {
+		name := "NULL AS season_name"
+		join := ""
+
+		if hasSeasons {
+			name = "n.season_name"
+			join = "LEFT JOIN seasons n USING (league_id, season_id)"
+		}
+
+		return fmt.Sprintf(`
+			WITH session_counts AS (%s)
+			SELECT
+				s.league_id,
+				s.season_id,
+				%s,
+				s.retired,
+				s.complete,
+				s.synced_at,
+				coalesce(c.sessions, 0) AS sessions,
+				coalesce(c.results, 0) AS results,
+				coalesce(c.lap_data, 0) AS lap_data,
+				coalesce(c.event_logs, 0) AS event_logs
+			FROM manifest.seasons s
+			LEFT JOIN session_counts c USING (league_id, season_id)
+			%s
+			ORDER BY s.league_id, s.season_id`, sessionCounts, name, join)
+	}
+
+	name := "NULL AS league_name"
+	join := ""
+
+	if hasLeague {
+		name = "n.league_name"
+		join = "LEFT JOIN league n USING (league_id)"
+	}
+
+	return fmt.Sprintf(`
+		WITH
+			session_counts AS (%s),
+			season_counts AS (
+				SELECT
+					league_id,
+					count(*) AS seasons,
+					count(*) FILTER (WHERE complete) AS complete_seasons
+				FROM manifest.seasons
+				GROUP BY league_id
+			)
+		SELECT
+			l.league_id,
+			%s,
+			l.synced_at,
+			coalesce(s.seasons, 0) AS seasons,
+			coalesce(s.complete_seasons, 0) AS complete_seasons,
+			coalesce(c.sessions, 0) AS sessions,
+			coalesce(c.results, 0) AS results,
+			coalesce(c.lap_data, 0) AS lap_data,
+			coalesce(c.event_logs, 0) AS event_logs
+		FROM manifest.leagues l
+		LEFT JOIN season_counts s USING (league_id)
+		LEFT JOIN session_counts c USING (league_id)
+		%s
+		ORDER BY l.league_id`, sessionCounts, name, join)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Team races have a row per team in team-results, with its drivers nested in
+// it, and lap data per team, the team being the group_id of its lap data.  To hold every driver to account for their part in
+// a team's race, the team_driver_results table has a row per driver of a team
+// and the stints table a row per stint, a run of consecutive laps by the same
+// driver of a team.  Both are derived from the others at the end of a sync.
+
+var teamTables = []string{
+	"team_driver_results",
+	"stints",
+}
+
+// teamQueries are the SQL that derives each of teamTables from team-results, in
+// %[1]s, and lap_data, in %[2]s
+var teamQueries = map[string]string{
+	"team_driver_results": `
+		SELECT
+			league_id,
+			season_id,
+			subsession_id,
+			simsession_number,
+			simsession_name,
+			simsession_type,
+			simsession_type_name,
+			simsession_subtype,
+			weather_result,
+			unnest(d)
+		FROM (
+			SELECT *, unnest(t.driver_results) AS d
+			FROM (SELECT * EXCLUDE (results), unnest(results) AS t FROM %[1]s)
+		)
+		ORDER BY league_id, season_id, subsession_id, simsession_number, d.team_id, d.cust_id`,
+
+	"stints": `
+		WITH laps AS (
+			SELECT
+				league_id,
+				season_id,
+				session_info.subsession_id AS subsession_id,
+				session_info.simsession_number AS simsession_number,
+				group_id AS team_id,
+				unnest(events) AS e
+			FROM %[2]s
+			WHERE group_id IS NOT NULL AND session_info.subsession_id IN (SELECT subsession_id FROM %[1]s)
+		),
+		changes AS (
+			SELECT
+				*,
+				coalesce(e.cust_id <> lag(e.cust_id) OVER (
+					PARTITION BY subsession_id, simsession_number, team_id ORDER BY e.lap_number), true) AS change
+			FROM laps
+			WHERE e.lap_number > 0
+		),
+		numbered AS (
+			SELECT
+				*,
+				sum(change::INTEGER) OVER (
+					PARTITION BY subsession_id, simsession_number, team_id ORDER BY e.lap_number) AS stint
+			FROM changes
+		)
+		SELECT
+			league_id,
+			season_id,
+			subsession_id,
+			simsession_number,
+			team_id,
+			stint,
+			e.cust_id AS cust_id,
+			min(e.lap_number) AS first_lap,
+			max(e.lap_number) AS last_lap,
+			count(*) AS laps,
+			count(*) FILTER (WHERE e.is_clean_lap) AS clean_laps,
+			min(e.lap_seconds) AS best_lap_seconds,
+			avg(e.lap_seconds) AS average_lap_seconds,
+			avg(e.lap_seconds) FILTER (WHERE e.is_clean_lap) AS average_clean_lap_seconds,
+			count(*) FILTER (WHERE e.incident) AS incident_laps,
+			count(*) FILTER (WHERE e.pitted) AS pitted_laps
+		FROM numbered
+		GROUP BY league_id, season_id, subsession_id, simsession_number, team_id, stint, e.cust_id
+		ORDER BY league_id, season_id, subsession_id, simsession_number, team_id, stint`,
+}
+
+// processTeams derives the team tables, unless no team race was ever synced
+func (l *League) processTeams() error {
+	exists, err := l.store.Exists("team-results")
+	if !exists {
+		return err
+	}
+
+	laps, err := l.store.Exists("lap_data")
+	if err != nil {
+		return err
+	}
+
+	for _, table := range teamTables {
+		if table == "stints" && !laps {
+			continue
+		}
+
+		query := fmt.Sprintf(teamQueries[table], l.store.Query("team-results"), l.store.Query("lap_data"))
+
+		err = l.store.Derive(table, query)
+		if err != nil {
+			return fmt.Errorf("deriving %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Every sync ends with a validation of the dataset it is about to swap in,
+// checking that what landed in parquet is what the API advertised.  Errors are
+// things that are wrong with the dataset, e.g. duplicate rows or results that
+// were never written, and fail the sync, although the dataset is still swapped
+// in.  Warnings are worth a look but may well be how the data is.  The report
+// is kept in <dir>/validation.json and the validate command checks a dataset
+// at any time.
+
+const validationFile = "validation.json"
+
+// nullHeavy is the percentage of NULLs from which a column gets a warning
+const nullHeavy = 90
+
+type finding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"`
+	Table    string `json:"table"`
+	Message  string `json:"message"`
+}
+
+type validation struct {
+	Dir         string    `json:"dir"`
+	ValidatedAt time.Time `json:"validated_at"`
+	Errors      int       `json:"errors"`
+	Warnings    int       `json:"warnings"`
+	Findings    []finding `json:"findings"`
+}
+
+// validationChecks are the checks that are a query each, returning the table
+// and a message for every finding.  A check is skipped unless one of its
+// tables has been synced.
+var validationChecks = []struct {
+	name     string
+	severity string
+	tables   []string
+	sql      string
+}{
+	{"session_counts", "error", []string{"results", "team-results"}, `
+		WITH
+			advertised AS (
+				SELECT league_id, season_id, count(DISTINCT subsession_id) FILTER (WHERE has_results) AS sessions
+				FROM sessions
+				GROUP BY ALL
+			),
+			synced AS (
+				SELECT league_id, season_id, count(DISTINCT subsession_id) AS sessions
+				FROM (SELECT league_id, season_id, subsession_id FROM results
+					UNION ALL SELECT league_id, season_id, subsession_id FROM team_results)
+				GROUP BY ALL
+			)
+		SELECT
+			'sessions',
+			format('season {} of league {} has {} sessions with results in season_sessions but {} synced',
+				season_id, league_id, coalesce(a.sessions, 0), coalesce(s.sessions, 0))
+		FROM advertised a
+		FULL OUTER JOIN synced s USING (league_id, season_id)
+		WHERE coalesce(a.sessions, 0) <> coalesce(s.sessions, 0)
+		ORDER BY league_id, season_id`},
+
+	{"sessions_without_results", "error", []string{"results", "team-results"}, `
+		SELECT
+			'sessions',
+			format('subsession {} of season {} has results but no rows in results or team_results', subsession_id, season_id)
+		FROM sessions
+		WHERE has_results AND subsession_id NOT IN (
+			SELECT subsession_id FROM results UNION SELECT subsession_id FROM team_results)
+		ORDER BY league_id, season_id, subsession_id`},
+
+	// only the subsessions that the manifest has the lap data of are checked
+	// so that it makes no difference whether lap data was left out with -tables
+	{"results_without_lap_data", "error", []string{"lap_data"}, `
+		WITH entries AS (
+			SELECT 'results' AS tbl, subsession_id, simsession_number, r.cust_id AS cust_id, NULL::BIGINT AS team_id
+			FROM (SELECT subsession_id, simsession_number, unnest(results) AS r FROM results)
+			UNION ALL
+			SELECT 'team_results', subsession_id, simsession_number, NULL, r.team_id
+			FROM (SELECT subsession_id, simsession_number, unnest(results) AS r FROM team_results)
+		)
+		SELECT
+			tbl,
+			format('subsession {} simsession {} has no lap data for {} of its entries',
+				subsession_id, simsession_number, count(*))
+		FROM entries e
+		WHERE subsession_id IN (SELECT subsession_id FROM manifest.sessions WHERE lap_data_complete)
+			AND NOT EXISTS (
+				FROM lap_data l
+				WHERE l.session_info.subsession_id = e.subsession_id
+					AND l.session_info.simsession_number = e.simsession_number
+					AND (l.cust_id = e.cust_id OR l.team_id = e.team_id)
+			)
+		GROUP BY tbl, subsession_id, simsession_number
+		ORDER BY tbl, subsession_id, simsession_number`},
+}
+
+// Validate checks the dataset in dir
+func Validate(dir string) (*validation, error) {
+	db, synced, err := openDataset(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	defer db.Close()
+
+	_, err = db.ExecContext(context.Background(),
+		fmt.Sprintf("ATTACH '%s' AS manifest (READ_ONLY)", filepath.Join(dir, manifestFile)))
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validation{Dir: dir, ValidatedAt: time.Now().UTC(), Findings: []finding{}}
+
+	for _, c := range validationChecks {
+		if !slices.ContainsFunc(c.tables, func(t string) bool { return slices.Contains(synced, t) }) {
+			continue
+		}
+
+		err = v.query(db, c.severity, c.name, c.sql)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.name, err)
+		}
+	}
+
+	for _, table := range synced {
+		err = v.checkKeys(db, table)
+		if err != nil {
+			return nil, fmt.Errorf("duplicate_keys: %w", err)
+		}
+
+		err = v.checkNulls(db, table)
+		if err != nil {
+			return nil, fmt.Errorf("null_columns: %w", err)
+		}
+	}
+
+	// errors first
+	slices.SortStableFunc(v.Findings, func(a, b finding) int {
+		return strings.Compare(a.Severity, b.Severity)
+	})
+
+	return v, nil
+}
+
+func (v *validation) add(severity string, check string, table string, message string) {
+	v.Findings = append(v.Findings, finding{severity, check, table, message})
+
+	if severity == "error" {
+		v.Errors++
+	} else {
+		v.Warnings++
+	}
+}
+
+// query adds a finding for every row of query, a table and a message
+func (v *validation) query(db *sql.DB, severity string, check string, query string) error {
+	rows, err := db.QueryContext(context.Background(), query)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, message string
+
+		err = rows.Scan(&table, &message)
+		if err != nil {
+			return err
+		}
+
+		v.add(severity, check, table, message)
+	}
+
+	return rows.Err()
+}
+
+// checkKeys adds an error if any two rows of table have the same primary key
+func (v *validation) checkKeys(db *sql.DB, table string) error {
+	keys, ok := primaryKeys[table]
+	if !ok {
+		return nil
+	}
+
+	var duplicates int
+
+	err := db.QueryRowContext(context.Background(), fmt.Sprintf(`
+		SELECT count(*) FROM (SELECT %s FROM %s GROUP BY ALL HAVING count(*) > 1)`,
+		strings.Join(keys, ", "), tableName(table))).Scan(&duplicates)
+	if err != nil {
+		return err
+	}
+
+	if duplicates > 0 {
+		v.add("error", "duplicate_keys", tableName(table),
+			fmt.Sprintf("%d keys (%s) have more than one row", duplicates, strings.Join(keys, ", ")))
+	}
+
+	return nil
+}
+
+// checkNulls adds a warning for every column of table that is mostly NULL
+func (v *validation) checkNulls(db *sql.DB, table string) error {
+	names, _, err := columns(db, tableName(table))
+	if err != nil {
+		return err
+	}
+
+	counts := make([]string, len(names))
+	for i, name := range names {
+		counts[i] = fmt.Sprintf(`count("%s")`, name)
+	}
+
+	values := make([]int64, len(names)+1)
+	pointers := make([]any, len(values))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+
+	err = db.QueryRowContext(context.Background(),
+		fmt.Sprintf("SELECT count(*), %s FROM %s", strings.Join(counts, ", "), tableName(table))).Scan(pointers...)
+	if err != nil {
+		return err
+	}
+
+	rows := values[0]
+	if rows == 0 {
+		return nil
+	}
+
+	for i, name := range names {
+		nulls := 100 * (rows - values[i+1]) / rows
+
+		if nulls >= nullHeavy {
+			v.add("warning", "null_columns", tableName(table), fmt.Sprintf("%s is %d%% NULL", name, nulls))
+		}
+	}
+
+	return nil
+}
+
+func (v *validation) print(w io.Writer) error {
+	fmt.Fprintf(w, "Validated %s: %d errors, %d warnings\n", v.Dir, v.Errors, v.Warnings)
+
+	if len(v.Findings) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	for _, f := range v.Findings {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", f.Severity, f.Check, f.Table, f.Message)
+	}
+
+	return tw.Flush()
+}
+
+// write writes the report to <dir>/validation.json
+func (v *validation) write(dir string) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, validationFile), data, 0644)
+}
+
+func validateCommand(fs *flag.FlagSet, args []string) error {
+	var dir, format string
+
+	dirFlag(fs, &dir)
+	fs.StringVar(&format, "format", "text", "report format, text or json")
+
+	fs.Parse(args)
+
+	if fs.NArg() != 0 || (format != "text" && format != "json") {
+		return errUsage
+	}
+
+	v, err := Validate(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(v)
+	} else {
+		err = v.print(os.Stdout)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if v.Errors > 0 {
+		return fmt.Errorf("%s failed validation with %d errors", dir, v.Errors)
+	}
+
+	return nil
+}
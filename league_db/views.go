@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// league_db ships the views everybody would otherwise write for themselves so
+// that everybody gets the same numbers.  They are created in the database the
+// status, export and query commands open and, with -duckdb, in league.duckdb.
+//
+// Races are the simsessions numbered 0, the main event of a session.  Positions
+// start at 1 and times are in seconds rather than iRacing's ten-thousandths.
+
+type analyticView struct {
+	name string
+	doc  string
+	sql  string
+}
+
+// entryColumns are the columns of race_results that driver and team entries
+// have in common
+const entryColumns = `
+	r.car_class_id,
+	r.car_id,
+	r.starting_position + 1 AS starting_position,
+	r.finish_position + 1 AS finish_position,
+	r.finish_position_in_class + 1 AS finish_position_in_class,
+	r.laps_complete,
+	r.laps_lead,
+	r.incidents,
+	nullif(r.best_lap_time, -1) / 10000 AS best_lap_seconds,
+	nullif(r.average_lap, -1) / 10000 AS average_lap_seconds,
+	r.reason_out,
+	r.champ_points,
+	r.league_points`
+
+var analyticViews = []analyticView{
+	{"race_results", "the classification of every race, a row per driver or, in team races, per team", `
+		WITH entries AS (
+			SELECT league_id, season_id, subsession_id, r.cust_id, NULL::BIGINT AS team_id, NULL AS team_name, ` + entryColumns + `
+			FROM (SELECT league_id, season_id, subsession_id, unnest(results) AS r FROM results WHERE simsession_number = 0)
+			UNION ALL BY NAME
+			SELECT league_id, season_id, subsession_id, NULL::BIGINT AS cust_id, r.team_id, r.display_name AS team_name, ` + entryColumns + `
+			FROM (SELECT league_id, season_id, subsession_id, unnest(results) AS r FROM team_results WHERE simsession_number = 0)
+		)
+		SELECT
+			e.league_id,
+			e.season_id,
+			e.subsession_id,
+			s.launch_at,
+			s.track_id,
+			t.track_name,
+			t.config_name,
+			e.cust_id,
+			e.team_id,
+			coalesce(d.display_name, e.team_name) AS display_name,
+			e.car_class_id,
+			cc.car_class_name,
+			e.car_id,
+			c.car_name,
+			e.* EXCLUDE (league_id, season_id, subsession_id, cust_id, team_id, team_name, car_class_id, car_id)
+		FROM entries e
+		LEFT JOIN sessions s ON s.subsession_id = e.subsession_id
+		LEFT JOIN tracks t ON t.track_id = s.track_id
+		LEFT JOIN drivers d ON d.cust_id = e.cust_id
+		LEFT JOIN cars c ON c.car_id = e.car_id
+		LEFT JOIN car_classes cc ON cc.car_class_id = e.car_class_id
+		ORDER BY e.league_id, e.season_id, s.launch_at, e.subsession_id, e.finish_position`},
+
+	{"race_drivers", "a row per driver per race, the drivers of a team sharing its positions and points", `
+		SELECT * FROM race_results WHERE cust_id IS NOT NULL
+		UNION ALL BY NAME
+		SELECT
+			t.* EXCLUDE (cust_id, display_name, laps_complete, laps_lead, incidents, best_lap_seconds, average_lap_seconds),
+			d.cust_id,
+			n.display_name,
+			d.laps_complete,
+			d.laps_lead,
+			d.incidents,
+			nullif(d.best_lap_time, -1) / 10000 AS best_lap_seconds,
+			nullif(d.average_lap, -1) / 10000 AS average_lap_seconds
+		FROM race_results t
+		JOIN (
+			SELECT subsession_id, r.team_id AS team_id, unnest(r.driver_results) AS d
+			FROM (SELECT subsession_id, unnest(results) AS r FROM team_results WHERE simsession_number = 0)
+		) USING (subsession_id, team_id)
+		LEFT JOIN drivers n ON n.cust_id = d.cust_id`},
+
+	{"driver_season_summary", "the races, results, incidents and points of every driver in every season", `
+		SELECT
+			league_id,
+			season_id,
+			cust_id,
+			arg_max(display_name, launch_at) AS display_name,
+			count(*) AS races,
+			count(*) FILTER (WHERE finish_position = 1) AS wins,
+			count(*) FILTER (WHERE finish_position <= 3) AS podiums,
+			count(*) FILTER (WHERE starting_position = 1) AS poles,
+			count(*) FILTER (WHERE reason_out <> 'Running') AS dnfs,
+			min(finish_position) AS best_finish,
+			round(avg(finish_position), 2) AS average_finish,
+			round(avg(starting_position), 2) AS average_start,
+			sum(laps_complete) AS laps,
+			sum(laps_lead) AS laps_led,
+			sum(incidents) AS incidents,
+			round(sum(incidents) / count(*), 2) AS incidents_per_race,
+			round(sum(incidents) / nullif(sum(laps_complete), 0), 3) AS incidents_per_lap,
+			sum(league_points) AS points
+		FROM race_drivers
+		GROUP BY league_id, season_id, cust_id
+		ORDER BY league_id, season_id, points DESC NULLS LAST, cust_id`},
+
+	{"fastest_laps", "everybody's fastest lap in every simsession, ranked", `
+		WITH laps AS (
+			SELECT
+				league_id,
+				season_id,
+				session_info.subsession_id AS subsession_id,
+				session_info.simsession_number AS simsession_number,
+				session_info.simsession_name AS simsession_name,
+				unnest(events) AS e
+			FROM lap_data
+		),
+		best AS (
+			SELECT
+				league_id,
+				season_id,
+				subsession_id,
+				simsession_number,
+				simsession_name,
+				e.cust_id AS cust_id,
+				e.lap_number AS lap_number,
+				e.lap_seconds AS lap_seconds
+			FROM laps
+			WHERE e.lap_number > 0 AND e.lap_seconds IS NOT NULL
+			QUALIFY row_number() OVER (
+				PARTITION BY subsession_id, simsession_number, e.cust_id ORDER BY e.lap_time, e.lap_number) = 1
+		)
+		SELECT
+			rank() OVER (PARTITION BY subsession_id, simsession_number ORDER BY lap_seconds) AS rank,
+			b.* EXCLUDE (lap_number, lap_seconds),
+			d.display_name,
+			b.lap_number,
+			b.lap_seconds
+		FROM best b
+		LEFT JOIN drivers d USING (cust_id)
+		ORDER BY league_id, season_id, subsession_id, simsession_number, rank`},
+
+	{"incidents_per_lap", "how many drivers had an incident, and of what kind, on every lap of every race", `
+		SELECT
+			league_id,
+			season_id,
+			session_info.subsession_id AS subsession_id,
+			e.lap_number AS lap_number,
+			count(*) AS drivers,
+			count(*) FILTER (WHERE e.incident) AS incidents,
+			count(*) FILTER (WHERE e.off_track) AS off_tracks,
+			count(*) FILTER (WHERE e.lost_control) AS lost_controls,
+			count(*) FILTER (WHERE e.car_contact) AS car_contacts,
+			count(*) FILTER (WHERE e.contact) AS contacts
+		FROM (SELECT league_id, season_id, session_info, unnest(events) AS e FROM lap_data WHERE session_info.simsession_number = 0)
+		GROUP BY ALL
+		ORDER BY ALL`},
+
+	{"attendance", "the races every driver, or current member of the league, turned up to in every season", `
+		WITH races AS (
+			SELECT league_id, season_id, count(DISTINCT subsession_id) AS races, max(launch_at) AS last_race
+			FROM race_results
+			GROUP BY ALL
+		),
+		attended AS (
+			SELECT league_id, season_id, cust_id, arg_max(display_name, launch_at) AS display_name, count(DISTINCT subsession_id) AS attended
+			FROM race_drivers
+			GROUP BY ALL
+		),
+		members AS (
+			SELECT r.league_id, s.season_id, r.cust_id, r.display_name, 0 AS attended
+			FROM roster r
+			JOIN races s ON s.league_id = r.league_id AND (r.league_member_since IS NULL OR r.league_member_since <= s.last_race)
+			WHERE NOT EXISTS (FROM attended a WHERE a.league_id = r.league_id AND a.season_id = s.season_id AND a.cust_id = r.cust_id)
+		)
+		SELECT
+			a.league_id,
+			a.season_id,
+			a.cust_id,
+			a.display_name,
+			s.races,
+			a.attended,
+			round(a.attended / s.races, 3) AS attendance
+		FROM (FROM attended UNION ALL BY NAME FROM members) a
+		JOIN races s USING (league_id, season_id)
+		ORDER BY a.league_id, a.season_id, attendance DESC, a.cust_id`},
+
+	{"roster_membership", "when every member, past or current, was first and last seen in the roster of a league", `
+		SELECT
+			h.league_id,
+			h.cust_id,
+			d.display_name,
+			arg_max(h.nick_name, h.valid_from) AS nick_name,
+			min(h.valid_from) AS first_seen,
+			max(h.last_seen) AS last_seen,
+			CASE WHEN bool_or(h.valid_to IS NULL) THEN NULL ELSE max(h.valid_to) END AS left_at,
+			bool_or(h.valid_to IS NULL) AS member
+		FROM roster_history h
+		LEFT JOIN drivers d USING (cust_id)
+		GROUP BY h.league_id, h.cust_id, d.display_name
+		ORDER BY h.league_id, first_seen, h.cust_id`},
+}
+
+// analyticMacros are table macros, analytic views that take parameters
+var analyticMacros = []analyticView{
+	{"roster_as_of(as_of)", "the roster of every league as it was at as_of, according to roster_history", `
+		SELECT h.* EXCLUDE (valid_from, valid_to, last_seen), d.display_name
+		FROM roster_history h
+		LEFT JOIN drivers d USING (cust_id)
+		WHERE h.valid_from <= as_of::TIMESTAMP AND (h.valid_to IS NULL OR h.valid_to > as_of::TIMESTAMP)
+		ORDER BY h.league_id, h.cust_id`},
+}
+
+// createEmptyTable creates table, with no rows, unless there is one already
+func createEmptyTable(db *sql.DB, table string) error {
+	_, err := db.ExecContext(context.Background(),
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", tableName(table), schemas[table].columns()))
+
+	return err
+}
+
+// createViews creates the analytic views and macros in db, which must have
+// every table
+func createViews(db *sql.DB) error {
+	for _, v := range analyticViews {
+		_, err := db.ExecContext(context.Background(), fmt.Sprintf("CREATE OR REPLACE VIEW %s AS %s", v.name, v.sql))
+		if err != nil {
+			return fmt.Errorf("creating view %s: %w", v.name, err)
+		}
+	}
+
+	for _, m := range analyticMacros {
+		_, err := db.ExecContext(context.Background(), fmt.Sprintf("CREATE OR REPLACE MACRO %s AS TABLE %s", m.name, m.sql))
+		if err != nil {
+			return fmt.Errorf("creating macro %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
+
+// CreateViews adds the analytic views to league.duckdb.  Tables that were never
+// fetched, e.g. team results in leagues without team races, are created empty.
+// Parquet datasets get the views when the query command opens them.
+func (l *League) CreateViews() error {
+	if !l.opts.DuckDB {
+		return nil
+	}
+
+	for _, table := range slices.Concat(tables, derivedTables) {
+		err := createEmptyTable(l.db, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	return createViews(l.db)
+}
+
+// viewList describes the tables and analytic views that can be queried
+func viewList(tables []string) string {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "Tables:")
+	for _, t := range tables {
+		fmt.Fprintf(&b, "  %s\n", tableName(t))
+	}
+
+	fmt.Fprintln(&b, "\nViews:")
+	for _, v := range analyticViews {
+		fmt.Fprintf(&b, "  %-22s %s\n", v.name, v.doc)
+	}
+
+	fmt.Fprintln(&b, "\nMacros:")
+	for _, m := range analyticMacros {
+		fmt.Fprintf(&b, "  %-22s %s\n", m.name, m.doc)
+	}
+
+	return b.String()
+}
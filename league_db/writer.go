@@ -5,139 +5,511 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	_ "github.com/marcboeker/go-duckdb"
 )
 
-func (l *League) OpenWriter() {
+// the tables every sync produces (and exports to <dir>/<table>.parquet or, for
+// partitioned tables, <dir>/<table>/)
+var tables = []string{
+	"league",
+	"roster",
+	"seasons",
+	"points_systems",
+	"sessions",
+	"results",
+	"team-results",
+	"lap_data",
+	"event_log",
+}
+
+// the tables derived from the others at the end of a sync, see shared.go,
+// teams.go, history.go and schedule.go
+var derivedTables = slices.Concat(dimensionTables, teamTables, []string{rosterHistoryTable}, scheduleTables)
+
+// store is where the synced tables live between runs.
+//
+// Rows are written in parts (e.g. one part per subsession) that are folded into
+// their table by Merge.  Load is called for every table, derived ones too, at
+// the start of a sync, Save for every table at the end of it and Migrate rewrites a loaded table, written with an
+// earlier version of its schema, in its current one.  Once saved, tables can be
+// read with the SQL returned by Query and derived tables are created from such
+// queries with Derive.
+type store interface {
+	Load(table string) error
+	Clear(table string, leagueId int) error
+	Write(data any, table string, part string) error
+	Merge(table string) error
+	Save(table string) error
+	Migrate(table string, version int) error
+	SessionExists(table string, subsessionId int) (bool, error)
+
+	Exists(table string) (bool, error)
+	Query(table string) string
+	Derive(table string, query string) error
+}
+
+const duckDBFile = "league.duckdb"
+
+func (l *League) OpenWriter() error {
 	var err error
 
-	l.db, err = sql.Open("duckdb", "")
+	if l.opts.DuckDB {
+		l.db, err = sql.Open("duckdb", fmt.Sprintf("%s/%s", l.dir, duckDBFile))
+		l.store = &duckStore{db: l.db, dir: l.dir, touched: map[string]map[partition]bool{}}
+	} else {
+		l.db, err = sql.Open("duckdb", "")
+		l.store = &jsonStore{db: l.db, dir: l.dir}
+	}
+
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	// everything, including the attached manifest, has to go through a single
+	// connection since the temp tables only exist on the connection that made them
+	l.db.SetMaxOpenConns(1)
+
+	return nil
+}
+
+// storeName is what the store the tables are kept in is recorded as in the
+// manifest
+func (l *League) storeName() string {
+	if l.opts.DuckDB {
+		return "duckdb"
+	}
+
+	return "json"
 }
 
-func (l *League) CloseWriter() {
-	l.db.Close()
+func (l *League) CloseWriter() error {
+	return l.db.Close()
 }
 
-func getTmpFile(name string) *os.File {
+// writeTmpJson marshals data to a temp file which the caller must remove
+func writeTmpJson(data any, name string) (string, error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
 	f, err := os.CreateTemp(os.TempDir(), fmt.Sprintf("%s*.json", name))
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
 
-	return f
+	_, err = f.Write(bytes)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), f.Close()
 }
 
-func (l *League) WriteJson(data any, name string) {
-	bytes, err := json.Marshal(data)
+// columns returns the column names and types of the results of query in order
+func columns(db *sql.DB, query string) ([]string, []string, error) {
+	rows, err := db.QueryContext(context.Background(),
+		fmt.Sprintf("SELECT column_name, column_type FROM (DESCRIBE %s)", query))
 	if err != nil {
-		log.Panic(err)
+		return nil, nil, err
 	}
 
-	f := getTmpFile(name)
-	_, err = f.Write(bytes)
+	defer rows.Close()
+
+	var names, types []string
+
+	for rows.Next() {
+		var name, typ string
+
+		err = rows.Scan(&name, &typ)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		names = append(names, name)
+		types = append(types, typ)
+	}
+
+	return names, types, rows.Err()
+}
+
+// copyToParquet writes the results of query to fn through a temp file.  Parquet
+// files are never written in place as they're shared with the previous
+// dataset, see BeginStaging.
+func copyToParquet(db *sql.DB, query string, fn string) error {
+	tmp := fmt.Sprintf("%s/TMP_%s", filepath.Dir(fn), filepath.Base(fn))
+
+	sql := fmt.Sprintf("COPY (%s) TO '%s' (FORMAT PARQUET)", query, tmp)
+	_, err := db.ExecContext(context.Background(), sql)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	f.Close()
+	return os.Rename(tmp, fn)
+}
 
-	defer os.Remove(f.Name())
+// fileExists reports whether fn exists, failing on anything but it not existing
+func fileExists(fn string) (bool, error) {
+	_, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// containsFold reports whether names contains name ignoring case, which is
+// how DuckDB matches column names
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonStore keeps tables as parquet files and works on them as JSON files in
+// dir while a sync runs
+type jsonStore struct {
+	db  *sql.DB
+	dir string
+}
+
+// appendOnly tables are too big to merge every time some rows are added.
+// Their parts are written to <dir>/<table>.parts/ and compacted into the
+// table's partitions just once, by Save.
+var appendOnly = map[string]bool{
+	"lap_data": true,
+}
+
+func (s *jsonStore) partsDir(table string) string {
+	return fmt.Sprintf("%s/%s.parts", s.dir, table)
+}
+
+func (s *jsonStore) Write(data any, table string, part string) error {
+	name := table
+	if part != "" {
+		name = fmt.Sprintf("%s-%s", table, part)
+	}
+
+	fn := fmt.Sprintf("%s/%s.json", s.dir, name)
+
+	if appendOnly[table] {
+		err := os.MkdirAll(s.partsDir(table), 0755)
+		if err != nil {
+			return err
+		}
+
+		fn = fmt.Sprintf("%s/%s.json", s.partsDir(table), part)
+	}
+
+	tmp, err := writeTmpJson(data, name)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp)
 
 	// this conversion normalizes the raw json fixing stuff like
 	//  timestamps to be consistent
-	sql := fmt.Sprintf("COPY (SELECT * FROM read_json('%s')) TO 'data/%s.json'", f.Name(), name)
-	_, err = l.db.ExecContext(context.Background(), sql)
+	sql := fmt.Sprintf("COPY (SELECT * FROM %s) TO '%s'", readJson(table, tmp), fn)
+	_, err = s.db.ExecContext(context.Background(), sql)
+
+	return err
+}
+
+// Clear removes the rows of a league from <dir>/<table>.json.  Rows written
+// before tables had a league_id can't be told apart so they are all removed.
+func (s *jsonStore) Clear(table string, leagueId int) error {
+	fn := fmt.Sprintf("%s/%s.json", s.dir, table)
+
+	exists, err := fileExists(fn)
+	if !exists {
+		return err
+	}
+
+	var remaining int
+
+	names, _, err := columns(s.db, fmt.Sprintf("FROM read_json('%s')", fn))
+	if err != nil {
+		return err
+	}
+
+	if containsFold(names, "league_id") {
+		err = s.db.QueryRowContext(context.Background(),
+			fmt.Sprintf("SELECT count(*) FROM %s WHERE league_id IS DISTINCT FROM ?", readJson(table, fn)),
+			leagueId).Scan(&remaining)
+		if err != nil {
+			return err
+		}
+	}
+
+	if remaining == 0 {
+		return os.Remove(fn)
+	}
+
+	tmp := fmt.Sprintf("%s/TMP_%s.json", s.dir, table)
+
+	sql := fmt.Sprintf("COPY (SELECT * FROM %s WHERE league_id IS DISTINCT FROM %d) TO '%s'",
+		readJson(table, fn), leagueId, tmp)
+	_, err = s.db.ExecContext(context.Background(), sql)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	return os.Rename(tmp, fn)
 }
 
-func (l *League) MergeJson(pattern string, target string) {
-	tmp := fmt.Sprintf("data/TMP_%s.json", target)
-	merged := fmt.Sprintf("data/%s.json", target)
+func (s *jsonStore) Merge(table string) error {
+	if appendOnly[table] {
+		return nil
+	}
+
+	tmp := fmt.Sprintf("%s/TMP_%s.json", s.dir, table)
+	merged := fmt.Sprintf("%s/%s.json", s.dir, table)
 
-	files, err := filepath.Glob(fmt.Sprintf("data/%s.json", pattern))
+	files, err := filepath.Glob(fmt.Sprintf("%s/%s-*.json", s.dir, table))
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	if len(files) == 0 {
-		return
+		return nil
+	}
+
+	if partitioned[table] {
+		return s.mergePartitions(table, files)
 	}
 
-	_, err = os.Stat(merged)
+	exists, err := fileExists(merged)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Panic(err)
-		}
-	} else {
+		return err
+	}
+
+	sources := []string{readJson(table, files...)}
+
+	if exists {
+		sources = append(sources, readJson(table, merged))
 		files = append(files, merged)
 	}
 
-	sql := fmt.Sprintf("COPY (SELECT * FROM read_json(['%s'], union_by_name=true)) TO '%s'",
-		strings.Join(files, "','"), tmp)
-	_, err = l.db.ExecContext(context.Background(), sql)
+	sql := fmt.Sprintf("COPY (%s) TO '%s'", upsertQuery(table, sources...), tmp)
+	_, err = s.db.ExecContext(context.Background(), sql)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
 	for _, f := range files {
 		err = os.Remove(f)
-		if err != nil && os.IsNotExist(err) {
-			log.Panic(err)
+		if err != nil {
+			return err
 		}
 	}
 
-	err = os.Rename(tmp, merged)
+	return os.Rename(tmp, merged)
+}
+
+// mergePartitions adds the rows in files to the partitions they belong to,
+// replacing the rows with the same keys, and removes the files.  Existing rows
+// go through JSON too so that they can be coerced into the schema of the table
+// along with the new rows.
+func (s *jsonStore) mergePartitions(table string, files []string) error {
+	var existing []string
+
+	if !snapshot[table] {
+		var err error
+
+		existing, err = s.partitionsToJson(table, files)
+		if err != nil {
+			return err
+		}
+	}
+
+	sources := []string{readJson(table, files...)}
+
+	if len(existing) > 0 {
+		sources = append(sources, readJson(table, existing...))
+	}
+
+	files = append(existing, files...)
+
+	err := writePartitions(s.db, s.dir, upsertQuery(table, sources...), table)
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	for _, f := range files {
+		err = os.Remove(f)
+		if err != nil {
+			return err
+		}
 	}
+
+	return nil
 }
 
-func (l *League) SessionExists(sessionPrefix string, subsessionId int) bool {
-	_, err := os.Stat(fmt.Sprintf("data/%sresults.parquet", sessionPrefix))
-	if os.IsNotExist(err) {
-		return false
+// partitionsToJson copies the existing partitions that the rows in files
+// belong to into temp JSON files and returns their names
+func (s *jsonStore) partitionsToJson(table string, files []string) ([]string, error) {
+	partitions, err := partitionsOf(s.db, fmt.Sprintf("FROM %s", readJson(table, files...)))
+	if err != nil {
+		return nil, err
+	}
+
+	var existing []string
+
+	for _, p := range partitions {
+		exists, err := fileExists(partitionPath(s.dir, table, p))
+		if err != nil {
+			return existing, err
+		}
+
+		if !exists {
+			continue
+		}
+
+		fn := fmt.Sprintf("%s/TMP_%s_%d_%d.json", s.dir, table, p.leagueId, p.seasonId)
+
+		sql := fmt.Sprintf("COPY (SELECT * FROM %s) TO '%s'", readPartitions(s.dir, table, p), fn)
+		_, err = s.db.ExecContext(context.Background(), sql)
+		if err != nil {
+			return existing, err
+		}
+
+		existing = append(existing, fn)
 	}
 
+	return existing, nil
+}
+
+func (s *jsonStore) SessionExists(table string, subsessionId int) (bool, error) {
+	exists, err := s.Exists(table)
+	if !exists {
+		return false, err
+	}
+
+	sql := fmt.Sprintf("SELECT EXISTS (FROM %s WHERE subsession_id=%d)",
+		s.Query(table), subsessionId)
+
+	err = s.db.QueryRowContext(context.Background(), sql).Scan(&exists)
+
+	return exists, err
+}
+
+// Save converts <dir>/<table>.json to parquet.  Partitioned tables are written
+// by Merge already.
+func (s *jsonStore) Save(table string) error {
+	if appendOnly[table] {
+		return s.compact(table)
+	}
+
+	if partitioned[table] {
+		return nil
+	}
+
+	fn := fmt.Sprintf("%s/%s.json", s.dir, table)
+
+	exists, err := fileExists(fn)
+	if !exists {
+		return err
+	}
+
+	err = copyToParquet(s.db, fmt.Sprintf("SELECT * FROM %s", readJson(table, fn)),
+		fmt.Sprintf("%s/%s.parquet", s.dir, table))
 	if err != nil {
-		log.Panic(err)
+		return err
+	}
+
+	return os.Remove(fn)
+}
+
+// Migrate rewrites the partitions of a partitioned table in its schema, see
+// upgradeQuery.  Other tables are rewritten in their schema by every Save.
+func (s *jsonStore) Migrate(table string, version int) error {
+	if !partitioned[table] {
+		return nil
 	}
 
-	sql := fmt.Sprintf("SELECT EXISTS (FROM 'data/%sresults.parquet' WHERE subsession_id=%d)",
-		sessionPrefix, subsessionId)
+	tmp := fmt.Sprintf("%s/TMP_%s.json", s.dir, table)
 
-	var exists bool
-	err = l.db.QueryRowContext(context.Background(), sql).Scan(&exists)
+	sql := fmt.Sprintf("COPY (%s) TO '%s'", upgradeQuery(table, version, s.Query(table)), tmp)
+	_, err := s.db.ExecContext(context.Background(), sql)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	return exists
+	defer os.Remove(tmp)
+
+	return writePartitions(s.db, s.dir, fmt.Sprintf("SELECT * FROM %s", readJson(table, tmp)), table)
 }
 
-func (l *League) ConvertJsonToParquet(fn string) {
-	sql := fmt.Sprintf("COPY (SELECT * FROM read_json('data/%s.json')) TO 'data/%s.parquet'", fn, fn)
+// compact folds the parts of an append only table into its partitions
+func (s *jsonStore) compact(table string) error {
+	files, err := filepath.Glob(fmt.Sprintf("%s/*.json", s.partsDir(table)))
+	if err != nil {
+		return err
+	}
 
-	_, err := l.db.ExecContext(context.Background(), sql)
+	if len(files) == 0 {
+		return nil
+	}
+
+	err = s.mergePartitions(table, files)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	os.Remove(fmt.Sprintf("data/%s.json", fn))
+	return os.RemoveAll(s.partsDir(table))
 }
 
-func (l *League) ConvertParquetToJson(fn string) {
-	sql := fmt.Sprintf("COPY (SELECT * FROM read_parquet('data/%s.parquet')) TO 'data/%s.json'", fn, fn)
+// Load converts <dir>/<table>.parquet to JSON so that Merge can add to it.
+// Partitioned tables are merged a partition at a time instead and derived tables
+// are read straight from their parquet files.
+func (s *jsonStore) Load(table string) error {
+	if partitioned[table] || slices.Contains(derivedTables, table) {
+		return nil
+	}
+
+	fn := fmt.Sprintf("%s/%s.parquet", s.dir, table)
+
+	exists, err := fileExists(fn)
+	if !exists {
+		return err
+	}
+
+	sql := fmt.Sprintf("COPY (SELECT * FROM read_parquet('%s')) TO '%s/%s.json'", fn, s.dir, table)
+	_, err = s.db.ExecContext(context.Background(), sql)
+
+	return err
+}
+
+func (s *jsonStore) Exists(table string) (bool, error) {
+	fn := fmt.Sprintf("%s/%s.parquet", s.dir, table)
+	if partitioned[table] {
+		fn = fmt.Sprintf("%s/%s", s.dir, table)
+	}
+
+	return fileExists(fn)
+}
+
+func (s *jsonStore) Query(table string) string {
+	if partitioned[table] {
+		return readPartitions(s.dir, table)
+	}
+
+	return fmt.Sprintf("read_parquet('%s/%s.parquet')", s.dir, table)
+}
 
-	// ignore errors
-	l.db.ExecContext(context.Background(), sql)
+// Derive writes the results of query to <dir>/<table>.parquet
+func (s *jsonStore) Derive(table string, query string) error {
+	return copyToParquet(s.db, query, fmt.Sprintf("%s/%s.parquet", s.dir, table))
 }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	_ "github.com/marcboeker/go-duckdb"
+)
+
+// With -dataset the races are read from a dataset synced by league_db rather
+// than from the API, through an in-memory DuckDB, and no credentials are
+// needed.  The results in the dataset have the week, start time and driver names
+// of the races, other than those synced by a league_db from before it kept
+// them.  For those the name a driver raced under is the one in their lap data,
+// or the one in drivers when they didn't complete a lap, the week of a race is
+// the number of its session in the season and its start time is when the
+// session launched.  The names of tracks, cars and classes are those they were
+// raced under, from the sessions and results, or the current ones, from the
+// tracks, cars and car_classes tables, for the races synced by a league_db from
+// before it kept them.
+
+// datasetTables are the tables of a dataset read, and whether they are
+// partitioned by league and season
+var datasetTables = map[string]bool{
+	"seasons":      false,
+	"sessions":     true,
+	"results":      true,
+	"team-results": true,
+	"lap_data":     true,
+	"drivers":      false,
+	"tracks":       false,
+	"cars":         false,
+	"car_classes":  false,
+}
+
+// readDataset returns the SQL that reads table from the dataset in dir, or
+// nothing when the dataset doesn't have it
+func readDataset(dir string, table string) (string, error) {
+	fn := filepath.Join(dir, table+".parquet")
+	if datasetTables[table] {
+		fn = filepath.Join(dir, table)
+	}
+
+	_, err := os.Stat(fn)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if datasetTables[table] {
+		return fmt.Sprintf("read_parquet('%s/*/*/*.parquet', hive_partitioning=true, union_by_name=true)", fn), nil
+	}
+
+	return fmt.Sprintf("read_parquet('%s')", fn), nil
+}
+
+// syncedColumns are the columns of the tables of a dataset that the league_db
+// it was synced by must have had
+var syncedColumns = map[string]string{
+	"sessions":     "track_name, config_name",
+	"results":      "race_week_num, start_time, results[1].car_name",
+	"team-results": "race_week_num, start_time, results[1].car_name",
+}
+
+// entryQueries are the SQL that reads the driver results of the races of a
+// season from results, and team-results, in %s.  The drivers of a team drive
+// its car and have the incidents of its laps.
+var entryQueries = map[string]string{
+	"results": `
+		SELECT subsession_id, simsession_number, race_week_num, start_time, d.cust_id, d.display_name,
+			NULL::BIGINT AS team_id, d.car_id, d.car_name, d.car_class_id, d.car_class_name,
+			d.laps_complete, d.incidents, d.ai
+		FROM (
+			SELECT subsession_id, simsession_number, race_week_num, start_time, unnest(results) AS d
+			FROM %s
+			WHERE league_id = $1 AND season_id = $2 AND simsession_type_name = 'Race'
+		)`,
+
+	"team-results": `
+		SELECT subsession_id, simsession_number, race_week_num, start_time, d.cust_id, d.display_name, t.team_id,
+			coalesce(d.car_id, t.car_id) AS car_id, coalesce(d.car_name, t.car_name) AS car_name,
+			coalesce(d.car_class_id, t.car_class_id) AS car_class_id,
+			coalesce(d.car_class_name, t.car_class_name) AS car_class_name,
+			d.laps_complete, d.incidents, d.ai
+		FROM (
+			SELECT subsession_id, simsession_number, race_week_num, start_time, t, unnest(t.driver_results) AS d
+			FROM (
+				SELECT subsession_id, simsession_number, race_week_num, start_time, unnest(results) AS t
+				FROM %s
+				WHERE league_id = $1 AND season_id = $2 AND simsession_type_name = 'Race'
+			)
+		)`,
+}
+
+// selectDatasetRacesSql reads a row per driver per race of a season from the
+// entries, in %[1]s, sessions, in %[2]s, and lap data, in %[3]s, with the
+// current names of drivers, tracks, cars and classes from %[4]s, %[5]s, %[6]s
+// and %[7]s for the races that don't have their own
+const selectDatasetRacesSql = `
+	WITH entries AS (%[1]s),
+	sessions AS (
+		SELECT
+			subsession_id,
+			has_results,
+			launch_at,
+			track_id,
+			track_name,
+			config_name,
+			row_number() OVER (ORDER BY launch_at, session_id) AS week
+		FROM %[2]s
+		WHERE league_id = $1 AND season_id = $2
+	),
+	laps AS (
+		SELECT
+			session_info.subsession_id AS subsession_id,
+			session_info.simsession_number AS simsession_number,
+			cust_id,
+			coalesce(group_id, team_id) AS team_id,
+			unnest(events) AS e
+		FROM %[3]s
+		WHERE league_id = $1 AND season_id = $2
+	),
+	incidents AS (
+		SELECT
+			subsession_id,
+			simsession_number,
+			cust_id,
+			team_id,
+			count(*) FILTER (WHERE event = 'off track') AS offtrack,
+			count(*) FILTER (WHERE event = 'contact') AS contact,
+			count(*) FILTER (WHERE event = 'car contact') AS car_contact,
+			count(*) FILTER (WHERE event = 'lost control') AS lost_control,
+			count(*) FILTER (WHERE event = 'black flag') AS black_flag
+		FROM (SELECT *, unnest(e.lap_events) AS event FROM laps WHERE e.incident)
+		GROUP BY ALL
+	),
+	names AS (
+		SELECT subsession_id, simsession_number, e.cust_id AS cust_id, arg_max(e.name, e.lap_number) AS name
+		FROM laps
+		WHERE e.name IS NOT NULL
+		GROUP BY ALL
+	)
+	SELECT
+		e.subsession_id,
+		e.simsession_number,
+		coalesce(e.start_time, s.launch_at),
+		coalesce(e.race_week_num + 1, s.week),
+		s.track_id,
+		CASE
+			WHEN s.track_name IS NULL AND t.config_name <> '' THEN concat(t.track_name, ' (', t.config_name, ')')
+			WHEN s.track_name IS NULL THEN t.track_name
+			WHEN s.config_name <> '' THEN concat(s.track_name, ' (', s.config_name, ')')
+			ELSE s.track_name
+		END,
+		e.cust_id,
+		coalesce(e.display_name, n.name, d.display_name, ''),
+		coalesce(e.ai, false),
+		coalesce(e.car_id, 0),
+		coalesce(e.car_name, c.car_name),
+		coalesce(e.car_class_id, 0),
+		coalesce(e.car_class_name, cc.car_class_name),
+		coalesce(e.laps_complete, 0),
+		coalesce(e.incidents, 0),
+		coalesce(i.offtrack, 0),
+		coalesce(i.contact, 0),
+		coalesce(i.car_contact, 0),
+		coalesce(i.lost_control, 0),
+		coalesce(i.black_flag, 0)
+	FROM entries e
+	JOIN sessions s ON s.subsession_id = e.subsession_id AND s.has_results
+	LEFT JOIN incidents i ON i.subsession_id = e.subsession_id AND i.simsession_number = e.simsession_number
+		AND CASE WHEN e.team_id IS NULL THEN i.cust_id = e.cust_id ELSE i.team_id = e.team_id END
+	LEFT JOIN names n ON n.subsession_id = e.subsession_id AND n.simsession_number = e.simsession_number AND n.cust_id = e.cust_id
+	LEFT JOIN %[4]s d ON d.cust_id = e.cust_id
+	LEFT JOIN %[5]s t ON t.track_id = s.track_id
+	LEFT JOIN %[6]s c ON c.car_id = e.car_id
+	LEFT JOIN %[7]s cc ON cc.car_class_id = e.car_class_id
+	ORDER BY s.week, e.subsession_id, e.simsession_number, e.cust_id
+`
+
+// processDataset adds up the races of a league in the league_db dataset in dir
+func processDataset(dir string, leagueId int64, ignoreSeasonIds []int) {
+	reads := map[string]string{}
+
+	for table := range datasetTables {
+		read, err := readDataset(dir, table)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		reads[table] = read
+	}
+
+	if reads["seasons"] == "" || reads["sessions"] == "" {
+		log.Fatalf("There is no league_db dataset in %s", dir)
+	}
+
+	var entries []string
+
+	for _, table := range []string{"results", "team-results"} {
+		if reads[table] != "" {
+			entries = append(entries, fmt.Sprintf(entryQueries[table], reads[table]))
+		}
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	for _, table := range []string{"lap_data", "drivers", "tracks", "cars", "car_classes"} {
+		if reads[table] == "" {
+			log.Fatalf("The dataset in %s has no %s", dir, table)
+		}
+	}
+
+	dataset, err := sql.Open("duckdb", "")
+	if err != nil {
+		log.Panic(err)
+	}
+
+	defer dataset.Close()
+
+	// datasets are brought up to date by syncing them, which migrates their
+	// sessions and results to the current schema
+	for table, columns := range syncedColumns {
+		if reads[table] == "" {
+			continue
+		}
+
+		_, err = dataset.Exec(fmt.Sprintf("SELECT %s FROM %s LIMIT 0", columns, reads[table]))
+		if err != nil {
+			log.Fatalf("The dataset in %s was synced by an earlier league_db, sync it again first: %v", dir, err)
+		}
+	}
+
+	rows, err := dataset.Query(fmt.Sprintf(`
+		SELECT season_id, season_name, coalesce(active, false)
+		FROM %s
+		WHERE league_id = $1
+		ORDER BY season_id
+	`, reads["seasons"]), leagueId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var seasons []raceT
+
+	for rows.Next() {
+		var season raceT
+
+		err := rows.Scan(&season.seasonId, &season.seasonName, &season.active)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		seasons = append(seasons, season)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	rows.Close()
+
+	selectRacesSql := fmt.Sprintf(selectDatasetRacesSql,
+		strings.Join(entries, "\nUNION ALL\n"),
+		reads["sessions"], reads["lap_data"], reads["drivers"], reads["tracks"], reads["cars"], reads["car_classes"])
+
+	for _, season := range seasons {
+		if slices.Contains(ignoreSeasonIds, season.seasonId) {
+			log.Printf("Skipping season: %s [%d]", season.seasonName, season.seasonId)
+			continue
+		}
+
+		processDatasetSeason(dataset, selectRacesSql, leagueId, season)
+	}
+}
+
+// processDatasetSeason adds up the races of season, read by selectRacesSql
+func processDatasetSeason(dataset *sql.DB, selectRacesSql string, leagueId int64, season raceT) {
+	log.Print(season.seasonName)
+
+	rows, err := dataset.Query(selectRacesSql, leagueId, season.seasonId)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			race      = season
+			dr        driverRaceT
+			startTime sql.NullTime
+			trackName sql.NullString
+			ai        bool
+			carName   sql.NullString
+			className sql.NullString
+		)
+
+		err := rows.Scan(
+			&race.subsessionId, &race.simsessionNumber, &startTime, &race.week, &race.trackId, &trackName,
+			&dr.custId, &dr.name, &ai, &dr.carId, &carName, &dr.carClassId, &className, &dr.laps, &dr.incidentPoints,
+			&dr.incidents.offtrack, &dr.incidents.contact, &dr.incidents.carContact, &dr.incidents.lostControl,
+			&dr.incidents.blackFlag,
+		)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		if ai {
+			log.Printf("%s is an AI Driver - skipping", dr.name)
+			continue
+		}
+
+		if startTime.Valid {
+			race.startTime = startTime.Time.UTC().Format(time.RFC3339)
+		}
+
+		race.trackName = trackName.String
+		dr.carName = carName
+		dr.carClassName = className
+
+		addRace(dr, race)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Panic(err)
+	}
+}
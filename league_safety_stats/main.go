@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -39,20 +39,75 @@ func init() {
 func main() {
 	var err error
 
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: stats <keyfile> <credsfile> <league id> [<ignored season ids>...]")
+	names := flag.Bool("names", false, "list every name each driver has raced under rather than their stats")
+	groupByList := flag.String("group-by", "", "comma separated groupings of the stats, of "+strings.Join(groupingNames(), ", ")+" (default lifetime totals)")
+	weights := flag.String("weights", defaultWeights, "comma separated <incident>=<weight> of the safety score, of "+strings.Join(incidentNames(), ", "))
+	per := flag.String("per", "lap", "what the safety score is per, lap or race")
+	minRaces := flag.Int("min-races", 1, "the races a driver needs to be ranked")
+	format := flag.String("format", "csv", "the format of the report, of "+strings.Join(formats, ", "))
+	output := flag.String("o", "", "the file the report is written to (default stdout)")
+	dataset := flag.String("dataset", "", "read the races from the league_db dataset in this directory rather than from the API")
+
+	flag.Parse()
+
+	args := flag.Args()
+
+	// a dataset synced by league_db needs no credentials
+	required := 3
+	if *dataset != "" {
+		required = 1
+	}
+
+	if len(args) < required {
+		fmt.Println("Usage: stats [-names] [-group-by <groupings>] [-weights <weights>] [-per lap|race] [-min-races <races>] [-format <format>] [-o <file>] <keyfile> <credsfile> <league id> [<ignored season ids>...]")
+		fmt.Println("       stats [<flags>...] -dataset <dir> <league id> [<ignored season ids>...]")
+		fmt.Println("With -dataset races synced by a league_db from before it kept the week, start time and driver names of")
+		fmt.Println("results have the week numbered by session, the launch time and the names in the lap data instead, and")
+		fmt.Println("those from before it kept the names of tracks, cars and classes have their current names")
 		os.Exit(1)
 	}
 
-	var (
-		keyFile   = os.Args[1]
-		credsFile = os.Args[2]
-		leagueId  = os.Args[3]
-	)
+	groupBy, err := parseGroupBy(*groupByList)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scoring, err := parseScoring(*weights, *per, *minRaces)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !slices.Contains(formats, *format) {
+		log.Fatalf("Not a format: %s", *format)
+	}
+
+	if *dataset == "" {
+		var (
+			keyFile   = args[0]
+			credsFile = args[1]
+		)
+
+		_, err = os.Stat(credsFile)
+		if err != nil {
+			err = ir.AuthAndSaveProvidedCredsToFile(keyFile, credsFile, credsProvider)
+		} else {
+			err = ir.AuthWithCredsFromFile(keyFile, credsFile)
+		}
+
+		if err != nil {
+			log.Panic(err)
+		}
+
+		ir.EnableCache(".cache")
+
+		args = args[2:]
+	}
+
+	leagueId := args[0]
 
 	var ignoreSeasonIds []int
 
-	for _, id := range os.Args[4:] {
+	for _, id := range args[1:] {
 		i, err := strconv.Atoi(id)
 		if err != nil {
 			log.Fatalf("Not a valid id: %v", id)
@@ -61,51 +116,102 @@ func main() {
 		ignoreSeasonIds = append(ignoreSeasonIds, i)
 	}
 
-	_, err = os.Stat(credsFile)
+	leagueIdNum, err := strconv.Atoi(leagueId)
 	if err != nil {
-		err = ir.AuthAndSaveProvidedCredsToFile(keyFile, credsFile, credsProvider)
+		log.Panic(err)
+	}
+
+	openDB()
+	defer db.Close()
+
+	if *dataset != "" {
+		processDataset(*dataset, int64(leagueIdNum), ignoreSeasonIds)
 	} else {
-		err = ir.AuthWithCredsFromFile(keyFile, credsFile)
+		processLeague(int64(leagueIdNum), ignoreSeasonIds)
 	}
 
-	if err != nil {
-		log.Panic(err)
+	var report reportT
+
+	if *names {
+		report = driverNamesReport(fmt.Sprintf("League %d driver names", leagueIdNum))
+	} else {
+		report = driversReport(fmt.Sprintf("League %d safety stats", leagueIdNum), groupBy, scoring)
 	}
 
-	ir.EnableCache(".cache")
+	out := os.Stdout
 
-	leagueIdNum, err := strconv.Atoi(leagueId)
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = report.write(out, *format)
 	if err != nil {
-		log.Panic(err)
+		log.Fatal(err)
 	}
 
+	err = out.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openDB creates the in-memory database the stats are added up in
+func openDB() {
+	var err error
+
 	db, err = sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		log.Panic(err)
 	}
-	defer db.Close()
 
-	createDriverStmt := `
-		CREATE TABLE driver (
-			name VARCHAR NOT NULL PRIMARY KEY,
-			active VARCHAR DEFAULT 'false',
-			races INTEGER,
+	// every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	// every race of every driver is a row of race, which the report adds up
+	// per driver and grouping.  Drivers are keyed by cust_id as display names
+	// change and aren't unique, the names they raced under are kept in
+	// driver_name.
+	createTablesStmt := `
+		CREATE TABLE race (
+			cust_id INTEGER NOT NULL,
+			subsession_id INTEGER NOT NULL,
+			simsession_number INTEGER NOT NULL,
+			season_id INTEGER,
+			season_name VARCHAR,
+			active INTEGER,
+			week INTEGER,
+			track_id INTEGER,
+			track_name VARCHAR,
+			car_id INTEGER,
+			car_name VARCHAR,
+			car_class_id INTEGER,
+			car_class_name VARCHAR,
 			laps INTEGER,
 			incident_points INTEGER,
 			incident_offtrack_count INTEGER,
 			incident_controlloss_count INTEGER,
 			incident_carcontact_count INTEGER,
 			incident_contact_count INTEGER,
-			blackflag_count INTEGER
-		)
+			blackflag_count INTEGER,
+			PRIMARY KEY (cust_id, subsession_id, simsession_number)
+		);
+
+		CREATE TABLE driver_name (
+			cust_id INTEGER NOT NULL,
+			name VARCHAR NOT NULL,
+			first_seen VARCHAR,
+			last_seen VARCHAR,
+			PRIMARY KEY (cust_id, name)
+		);
 	`
 
-	_, err = db.Exec(createDriverStmt)
+	_, err = db.Exec(createTablesStmt)
 	if err != nil {
 		log.Panic(err)
 	}
-
-	processLeague(int64(leagueIdNum), ignoreSeasonIds)
 }
 
 func processLeague(leagueId int64, ignoreSeasonIds []int) {
@@ -129,84 +235,230 @@ func processLeague(leagueId int64, ignoreSeasonIds []int) {
 			log.Printf("Skipping season: %s [%s]", season["season_name"], season["season_id"])
 		}
 	}
+}
 
-	selectDriversSql := `
-		SELECT
-		    name,
-			active,
-			races,
-		    laps,
-			incident_points,
-			incident_offtrack_count,
-			incident_controlloss_count,
-			incident_carcontact_count,
-			incident_contact_count,
-			blackflag_count
-		FROM driver
-	`
+// grouping is a way of breaking the stats of the drivers down, by the id
+// column of race with the name column shown for it
+type grouping struct {
+	name   string
+	id     string
+	column string
+	header string
+}
 
-	rows, err := db.Query(selectDriversSql)
-	if err != nil {
-		log.Panic(err)
+var groupings = []grouping{
+	{"season", "season_id", "season_name", "Season"},
+	{"week", "week", "week", "Week"},
+	{"track", "track_id", "track_name", "Track"},
+	{"car", "car_id", "car_name", "Car"},
+	{"class", "car_class_id", "car_class_name", "Class"},
+}
+
+func groupingNames() []string {
+	var names []string
+
+	for _, g := range groupings {
+		names = append(names, g.name)
 	}
 
-	fmt.Printf("Driver,Active,Races,Laps,Inc,Offtracks,ControlLosses,CarContacts,Contacts,BlackFlags\n")
+	return names
+}
 
-	for rows.Next() {
-		var (
-			name                       sql.NullString
-			active                     sql.NullString
-			races                      sql.NullInt64
-			laps                       sql.NullInt64
-			incident_points            sql.NullInt64
-			incident_offtrack_count    sql.NullInt64
-			incident_controlloss_count sql.NullInt64
-			incident_carcontact_count  sql.NullInt64
-			incident_contact_count     sql.NullInt64
-			blackflag_count            sql.NullInt64
-		)
+// parseGroupBy returns the groupings in list, a comma separated list of their
+// names.  No groupings at all are the lifetime totals of the drivers.
+func parseGroupBy(list string) ([]grouping, error) {
+	var groupBy []grouping
 
-		err := rows.Scan(
-			&name,
-			&active,
-			&races,
-			&laps,
-			&incident_points,
-			&incident_offtrack_count,
-			&incident_controlloss_count,
-			&incident_carcontact_count,
-			&incident_contact_count,
-			&blackflag_count,
-		)
+	if list == "" {
+		return groupBy, nil
+	}
+
+	for _, name := range strings.Split(list, ",") {
+		i := slices.IndexFunc(groupings, func(g grouping) bool { return g.name == strings.TrimSpace(name) })
+		if i < 0 {
+			return nil, fmt.Errorf("not a grouping: %s", name)
+		}
+
+		groupBy = append(groupBy, groupings[i])
+	}
+
+	return groupBy, nil
+}
+
+// incidentTypes are the incidents that count towards the safety score, by
+// the names they are weighted by and their column of race
+var incidentTypes = []struct {
+	name   string
+	column string
+}{
+	{"inc", "incident_points"},
+	{"offtrack", "incident_offtrack_count"},
+	{"controlloss", "incident_controlloss_count"},
+	{"carcontact", "incident_carcontact_count"},
+	{"contact", "incident_contact_count"},
+	{"blackflag", "blackflag_count"},
+}
+
+const defaultWeights = "offtrack=1,controlloss=2,carcontact=4"
+
+func incidentNames() []string {
+	var names []string
+
+	for _, t := range incidentTypes {
+		names = append(names, t.name)
+	}
+
+	return names
+}
+
+// scoringT is how the safety score of a driver is worked out: the weighted sum
+// of their incidents per lap or per race.  The lower the score the safer the
+// driver.  Drivers with fewer than minRaces races aren't ranked.
+type scoringT struct {
+	weights  map[string]float64
+	per      string
+	minRaces int
+}
+
+func parseScoring(weights string, per string, minRaces int) (scoringT, error) {
+	scoring := scoringT{weights: map[string]float64{}, per: per, minRaces: minRaces}
+
+	if per != "lap" && per != "race" {
+		return scoring, fmt.Errorf("not lap or race: %s", per)
+	}
+
+	for _, w := range strings.Split(weights, ",") {
+		if strings.TrimSpace(w) == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(w, "=")
+		name = strings.TrimSpace(name)
+
+		if !ok || !slices.Contains(incidentNames(), name) {
+			return scoring, fmt.Errorf("not a weight: %s", w)
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
 		if err != nil {
-			log.Panic(err)
+			return scoring, fmt.Errorf("not a weight: %s", w)
 		}
 
-		fmt.Printf("%s,%s,%d,%d,%d,%d,%d,%d,%d,%d\n",
-			name.String,
-			active.String,
-			races.Int64,
-			laps.Int64,
-			incident_points.Int64,
-			incident_offtrack_count.Int64,
-			incident_controlloss_count.Int64,
-			incident_carcontact_count.Int64,
-			incident_contact_count.Int64,
-			blackflag_count.Int64,
-			// incident_offtrack_count.Int64*1+
-			// 	incident_controlloss_count.Int64*2+
-			// 	incident_carcontact_count.Int64*4,
-		)
+		scoring.weights[name] = weight
 	}
+
+	return scoring, nil
 }
 
-// func ratio(driver *driverT) float64 {
-// 	if driver.laps == 0 {
-// 		return 0.0
-// 	}
+// sql returns the SQL that works out the score from the rows of race of a
+// driver
+func (s scoringT) sql() string {
+	terms := []string{"0"}
 
-// 	return float64(driver.incidents) / float64(driver.laps)
-// }
+	for _, t := range incidentTypes {
+		if w := s.weights[t.name]; w != 0 {
+			terms = append(terms, fmt.Sprintf("%g * sum(%s)", w, t.column))
+		}
+	}
+
+	per := "sum(laps)"
+	if s.per == "race" {
+		per = "count(*)"
+	}
+
+	return fmt.Sprintf("(%s) * 1.0 / nullif(%s, 0)", strings.Join(terms, " + "), per)
+}
+
+// driversReport is the stats and safety score of every driver, under the name
+// they last raced under, for each of the groupings in groupBy they raced in.
+// The drivers are ranked by their score within each grouping, the percentile
+// being the share of the other ranked drivers that aren't safer.
+func driversReport(title string, groupBy []grouping, scoring scoringT) reportT {
+	var groups, columns, ids, headers []string
+
+	for i, g := range groupBy {
+		groups = append(groups, fmt.Sprintf("%s AS id%d, min(%s) AS group%d,", g.id, i, g.column, i))
+		columns = append(columns, fmt.Sprintf("group%d,", i))
+		ids = append(ids, fmt.Sprintf("id%d", i))
+		headers = append(headers, g.header)
+	}
+
+	selectDriversSql := fmt.Sprintf(`
+		WITH totals AS (
+			SELECT
+				%s
+				cust_id,
+				(SELECT name FROM driver_name n WHERE n.cust_id = r.cust_id ORDER BY last_seen DESC LIMIT 1) AS name,
+				CASE WHEN max(active) THEN 'true' ELSE 'false' END AS active,
+				count(*) AS races,
+				sum(laps) AS laps,
+				sum(incident_points) AS incident_points,
+				sum(incident_offtrack_count) AS incident_offtrack_count,
+				sum(incident_controlloss_count) AS incident_controlloss_count,
+				sum(incident_carcontact_count) AS incident_carcontact_count,
+				sum(incident_contact_count) AS incident_contact_count,
+				sum(blackflag_count) AS blackflag_count,
+				%s AS score
+			FROM race r
+			GROUP BY %s
+		),
+		ranked AS (
+			SELECT *, races >= ? AND score IS NOT NULL AS ranked FROM totals
+		)
+		SELECT
+			%s
+			cust_id,
+			name,
+			active,
+			races,
+			laps,
+			incident_points,
+			incident_offtrack_count,
+			incident_controlloss_count,
+			incident_carcontact_count,
+			incident_contact_count,
+			blackflag_count,
+			round(score, 4),
+			CASE WHEN ranked THEN rank() OVER w END,
+			CASE WHEN ranked THEN round(100 * (1 - percent_rank() OVER w), 1) END
+		FROM ranked
+		WINDOW w AS (PARTITION BY %s ORDER BY score)
+		ORDER BY %s
+	`,
+		strings.Join(groups, "\n"),
+		scoring.sql(),
+		strings.Join(append(ids, "cust_id"), ", "),
+		strings.Join(columns, "\n"),
+		strings.Join(append(ids, "ranked"), ", "),
+		strings.Join(append(ids, "ranked DESC", "score", "cust_id"), ", "))
+
+	headers = append(headers, "CustId", "Driver", "Active", "Races", "Laps", "Inc", "Offtracks", "ControlLosses", "CarContacts", "Contacts", "BlackFlags", "Score", "Rank", "Percentile")
+
+	return queryReport(title, headers, selectDriversSql, scoring.minRaces)
+}
+
+// driverNamesReport is every name each driver has raced under, with the start
+// times of the first and last sessions they raced under it
+func driverNamesReport(title string) reportT {
+	return queryReport(title, []string{"CustId", "Driver", "FirstSeen", "LastSeen"}, `
+		SELECT cust_id, name, first_seen, last_seen
+		FROM driver_name
+		ORDER BY cust_id, last_seen DESC
+	`)
+}
+
+// raceT is what the rows of race of the drivers in a race have in common
+type raceT struct {
+	seasonId         int
+	seasonName       string
+	active           bool
+	subsessionId     int
+	simsessionNumber int
+	startTime        string
+	week             int
+	trackId          int
+	trackName        string
+}
 
 func processSeason(leagueId int64, season map[string]interface{}) {
 	id := int64(season["season_id"].(float64))
@@ -226,17 +478,21 @@ func processSeason(leagueId int64, season map[string]interface{}) {
 		log.Panic(err)
 	}
 
-	activeSeason := season["active"].(bool)
+	race := raceT{
+		seasonId:   int(id),
+		seasonName: name,
+		active:     season["active"].(bool),
+	}
 
 	for _, s := range sessions["sessions"].([]interface{}) {
 		session := s.(map[string]interface{})
 		if session["has_results"].(bool) {
-			processSession(session, activeSeason)
+			processSession(session, race)
 		}
 	}
 }
 
-func processSession(seasonSession map[string]interface{}, activeSeason bool) {
+func processSession(seasonSession map[string]interface{}, race raceT) {
 	if seasonSession["subsession_id"] == nil {
 		return
 	}
@@ -265,19 +521,35 @@ func processSession(seasonSession map[string]interface{}, activeSeason bool) {
 		if sr["simsession_type_name"] == "Race" {
 			track := subsession["track"].(map[string]interface{})
 			log.Printf("%s, Week %d [%s]", subsession["league_season_name"], int(subsession["race_week_num"].(float64))+1, track["track_name"])
+
+			race.subsessionId = int(subsession["subsession_id"].(float64))
+			race.simsessionNumber = int(sr["simsession_number"].(float64))
+			race.startTime, _ = subsession["start_time"].(string)
+			race.week = int(subsession["race_week_num"].(float64)) + 1
+			race.trackId = int(track["track_id"].(float64))
+			race.trackName = track["track_name"].(string)
+
+			if config, _ := track["config_name"].(string); config != "" {
+				race.trackName = fmt.Sprintf("%s (%s)", race.trackName, config)
+			}
+
 			for _, teamResult := range sr["results"].([]interface{}) {
 				tr := teamResult.(map[string]interface{})
 
-				subsession_id := int(subsession["subsession_id"].(float64))
-				simsession_number := int(sr["simsession_number"].(float64))
-
 				if tr["driver_results"] == nil {
-					processDriver(tr, subsession_id, simsession_number, activeSeason)
+					processDriver(tr, race)
 				} else {
 					for _, driverResult := range tr["driver_results"].([]interface{}) {
 						dr := driverResult.(map[string]interface{})
 
-						processDriver(dr, subsession_id, simsession_number, activeSeason)
+						// the drivers of a team drive its car
+						for _, key := range []string{"car_id", "car_name", "car_class_id", "car_class_name"} {
+							if dr[key] == nil {
+								dr[key] = tr[key]
+							}
+						}
+
+						processDriver(dr, race)
 					}
 				}
 			}
@@ -285,20 +557,36 @@ func processSession(seasonSession map[string]interface{}, activeSeason bool) {
 	}
 }
 
-func processDriver(dr map[string]interface{}, subsession_id int, simsession_number int, activeSeason bool) {
+// incidentCounterT counts the incidents of a driver in a race by the lap
+// events they were for
+type incidentCounterT struct {
+	offtrack    int
+	contact     int
+	carContact  int
+	lostControl int
+	blackFlag   int
+}
+
+// driverRaceT is what a row of race has of the driver in the race, and the
+// name they raced under
+type driverRaceT struct {
+	custId         int
+	name           string
+	carId          int
+	carName        any
+	carClassId     int
+	carClassName   any
+	laps           int
+	incidentPoints int
+	incidents      incidentCounterT
+}
+
+func processDriver(dr map[string]interface{}, race raceT) {
 	if dr["ai"].(bool) {
 		log.Printf("%s is an AI Driver - skipping", dr["display_name"].(string))
 		return
 	}
 
-	type incidentCounterT struct {
-		offtrack    int
-		contact     int
-		carContact  int
-		lostControl int
-		blackFlag   int
-	}
-
 	var lapDataParams string
 
 	if dr["team_id"] == nil {
@@ -310,7 +598,7 @@ func processDriver(dr map[string]interface{}, subsession_id int, simsession_numb
 	data, err := ir.GetWithCache(
 		fmt.Sprintf(
 			"/data/results/lap_data?subsession_id=%d&simsession_number=%d&%s",
-			subsession_id, simsession_number, lapDataParams),
+			race.subsessionId, race.simsessionNumber, lapDataParams),
 		time.Duration(resultCacheHours)*time.Hour,
 	)
 	if err != nil {
@@ -366,102 +654,72 @@ func processDriver(dr map[string]interface{}, subsession_id int, simsession_numb
 
 	log.Printf("incident log: [%s]", strings.Join(incidentLog, ", "))
 
-	name := dr["display_name"].(string)
-	laps := int(dr["laps_complete"].(float64))
-	incidentPoints := int(dr["incidents"].(float64))
+	// the names of cars and classes are NULL, rather than empty, when the
+	// result doesn't have them so that the report picks one that isn't
+	carId, _ := dr["car_id"].(float64)
+	carClassId, _ := dr["car_class_id"].(float64)
+
+	addRace(driverRaceT{
+		custId:         int(dr["cust_id"].(float64)),
+		name:           dr["display_name"].(string),
+		carId:          int(carId),
+		carName:        dr["car_name"],
+		carClassId:     int(carClassId),
+		carClassName:   dr["car_class_name"],
+		laps:           int(dr["laps_complete"].(float64)),
+		incidentPoints: int(dr["incidents"].(float64)),
+		incidents:      incidentCollector,
+	}, race)
+}
 
-	log.Printf("\t%s: laps: %d, incidents %d [%v]", name, laps, incidentPoints, incidentCollector)
+// addRace adds the row of race of a driver and the name they raced under
+func addRace(dr driverRaceT, race raceT) {
+	log.Printf("\t%s: laps: %d, incidents %d [%v]", dr.name, dr.laps, dr.incidentPoints, dr.incidents)
 
-	selectDriverStmt := `
-		SELECT
-			active,
-		    races,
-		    laps,
-		    incident_points,
-			incident_offtrack_count,
-			incident_controlloss_count,
-			incident_carcontact_count,
-			incident_contact_count,
-			blackflag_count
-		FROM driver WHERE name=?
+	insertRaceStmt := `
+		INSERT INTO race (
+			cust_id, subsession_id, simsession_number, season_id, season_name, active, week, track_id, track_name,
+			car_id, car_name, car_class_id, car_class_name, laps, incident_points, incident_offtrack_count,
+			incident_controlloss_count, incident_carcontact_count, incident_contact_count, blackflag_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 
-	var (
-		priorActive         string
-		priorRaces          int
-		priorLaps           int
-		priorIncidentPoints int
-		priorIncidentCounts incidentCounterT
+	_, err := db.Exec(insertRaceStmt,
+		dr.custId,
+		race.subsessionId,
+		race.simsessionNumber,
+		race.seasonId,
+		race.seasonName,
+		race.active,
+		race.week,
+		race.trackId,
+		race.trackName,
+		dr.carId,
+		dr.carName,
+		dr.carClassId,
+		dr.carClassName,
+		dr.laps,
+		dr.incidentPoints,
+		dr.incidents.offtrack,
+		dr.incidents.lostControl,
+		dr.incidents.carContact,
+		dr.incidents.contact,
+		dr.incidents.blackFlag,
 	)
-
-	err = db.QueryRow(selectDriverStmt, name).Scan(
-		&priorActive,
-		&priorRaces,
-		&priorLaps,
-		&priorIncidentPoints,
-		&priorIncidentCounts.offtrack,
-		&priorIncidentCounts.lostControl,
-		&priorIncidentCounts.carContact,
-		&priorIncidentCounts.contact,
-		&priorIncidentCounts.blackFlag,
-	)
-	if err == nil {
-		updateDriverStmt := `
-			UPDATE driver SET
-			    races=?,
-			    laps=?,
-			    incident_points=?,
-			    incident_offtrack_count=?,
-			    incident_controlloss_count=?,
-			    incident_carcontact_count=?,
-				incident_contact_count=?,
-				blackflag_count=?
-            WHERE name=?
-		`
-
-		_, err = db.Exec(updateDriverStmt,
-			priorRaces+1,
-			priorLaps+laps,
-			priorIncidentPoints+incidentPoints,
-			priorIncidentCounts.offtrack+incidentCollector.offtrack,
-			priorIncidentCounts.lostControl+incidentCollector.lostControl,
-			priorIncidentCounts.carContact+incidentCollector.carContact,
-			priorIncidentCounts.contact+incidentCollector.contact,
-			priorIncidentCounts.blackFlag+incidentCollector.blackFlag,
-			name)
-		if err != nil {
-			log.Panic(err)
-		}
-
-	} else if errors.Is(err, sql.ErrNoRows) {
-		insertDriverStmt := `
-			INSERT INTO driver
-			    (name, races, laps, incident_points, incident_offtrack_count, incident_controlloss_count, incident_carcontact_count, incident_contact_count, blackflag_count)
-			VALUES (?, 1, ?, ?, ?, ?, ?, ?, ?)
-		`
-
-		_, err = db.Exec(insertDriverStmt, name, laps,
-			incidentPoints,
-			incidentCollector.offtrack,
-			incidentCollector.lostControl,
-			incidentCollector.carContact,
-			incidentCollector.contact,
-			incidentCollector.blackFlag,
-		)
-		if err != nil {
-			log.Panic(err)
-		}
-	} else {
+	if err != nil {
 		log.Panic(err)
 	}
 
-	if priorActive == "false" && activeSeason {
-		updateActiveStmt := `
-			UPDATE driver SET active='true' WHERE name=?`
+	upsertNameStmt := `
+		INSERT INTO driver_name (cust_id, name, first_seen, last_seen)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (cust_id, name) DO UPDATE SET
+			first_seen=min(first_seen, excluded.first_seen),
+			last_seen=max(last_seen, excluded.last_seen)
+	`
 
-		_, err = db.Exec(updateActiveStmt, name)
-		if err != nil {
-			log.Panic(err)
-		}
+	_, err = db.Exec(upsertNameStmt, dr.custId, dr.name, race.startTime, race.startTime)
+	if err != nil {
+		log.Panic(err)
 	}
 }
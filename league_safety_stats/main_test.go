@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestDriversReportRanks checks the rank and percentile of drivers, scored by
+// their offtracks per race, who tie and who haven't raced the -min-races
+// needed to be ranked
+func TestDriversReportRanks(t *testing.T) {
+	// a race of a driver in a week, with offtracks offtracks
+	type raceOf struct {
+		custId    int
+		week      int
+		offtracks int
+	}
+
+	tests := []struct {
+		name     string
+		groupBy  string
+		minRaces int
+		races    []raceOf
+		want     []string
+	}{
+		{
+			"ties share a rank", "", 1,
+			[]raceOf{{1, 1, 0}, {2, 1, 0}, {3, 1, 2}},
+			[]string{"1 1 100", "2 1 100", "3 3 0"},
+		},
+		{
+			"ties after the first", "", 1,
+			[]raceOf{{1, 1, 0}, {2, 1, 1}, {3, 1, 1}, {4, 1, 2}},
+			[]string{"1 1 100", "2 2 66.7", "3 2 66.7", "4 4 0"},
+		},
+		{
+			"everybody tied", "", 1,
+			[]raceOf{{1, 1, 1}, {2, 1, 1}, {3, 1, 1}},
+			[]string{"1 1 100", "2 1 100", "3 1 100"},
+		},
+		{
+			"too few races to be ranked", "", 2,
+			[]raceOf{{1, 1, 0}, {1, 2, 0}, {2, 1, 1}, {2, 2, 1}, {3, 1, 0}, {4, 1, 3}, {4, 2, 3}},
+			[]string{"1 1 100", "2 2 50", "4 3 0", "3  "},
+		},
+		{
+			"ties with too few races", "", 2,
+			[]raceOf{{1, 1, 1}, {1, 2, 1}, {2, 1, 1}, {2, 2, 1}, {3, 1, 1}},
+			[]string{"1 1 100", "2 1 100", "3  "},
+		},
+		{
+			"a single ranked driver", "", 2,
+			[]raceOf{{1, 1, 2}, {1, 2, 2}, {2, 1, 0}},
+			[]string{"1 1 100", "2  "},
+		},
+		{
+			"ranked within each week", "week", 1,
+			[]raceOf{{1, 1, 0}, {2, 1, 0}, {1, 2, 2}, {2, 2, 1}, {3, 2, 1}},
+			[]string{"1 1 1 100", "1 2 1 100", "2 2 1 100", "2 3 1 100", "2 1 3 0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			openDB()
+			defer db.Close()
+
+			for i, r := range tt.races {
+				addRace(
+					driverRaceT{custId: r.custId, name: "Driver", laps: 10, incidents: incidentCounterT{offtrack: r.offtracks}},
+					raceT{seasonId: 1, subsessionId: i, week: r.week, startTime: "2024-01-01T18:00:00Z"})
+			}
+
+			groupBy, err := parseGroupBy(tt.groupBy)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			scoring, err := parseScoring(defaultWeights, "race", tt.minRaces)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			report := driversReport("", groupBy, scoring)
+
+			columns := []int{slices.Index(report.headers, "CustId"), slices.Index(report.headers, "Rank"),
+				slices.Index(report.headers, "Percentile")}
+			if tt.groupBy != "" {
+				columns = append([]int{0}, columns...)
+			}
+
+			var got []string
+
+			for _, row := range report.strings() {
+				var fields []string
+				for _, c := range columns {
+					fields = append(fields, row[c])
+				}
+
+				got = append(got, strings.Join(fields, " "))
+			}
+
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
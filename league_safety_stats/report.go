@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// reportT is a table of results, written in one of formats
+type reportT struct {
+	title   string
+	headers []string
+	rows    [][]any
+}
+
+var formats = []string{"csv", "json", "markdown", "html"}
+
+// queryReport runs query for the rows of a report with headers
+func queryReport(title string, headers []string, query string, args ...any) reportT {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	defer rows.Close()
+
+	report := reportT{title: title, headers: headers}
+
+	for rows.Next() {
+		values := make([]any, len(headers))
+		pointers := make([]any, len(values))
+
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+
+		err := rows.Scan(pointers...)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+
+		report.rows = append(report.rows, values)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return report
+}
+
+// format returns a value of a row as text, NULLs being empty
+func format(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (r reportT) write(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		return r.writeJSON(w)
+	case "markdown":
+		return r.writeMarkdown(w)
+	case "html":
+		return r.writeHTML(w)
+	default:
+		return r.writeCSV(w)
+	}
+}
+
+func (r reportT) strings() [][]string {
+	rows := make([][]string, len(r.rows))
+
+	for i, row := range r.rows {
+		rows[i] = make([]string, len(row))
+
+		for j, v := range row {
+			rows[i][j] = format(v)
+		}
+	}
+
+	return rows
+}
+
+func (r reportT) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+
+	err := cw.Write(r.headers)
+	if err != nil {
+		return err
+	}
+
+	err = cw.WriteAll(r.strings())
+	if err != nil {
+		return err
+	}
+
+	return cw.Error()
+}
+
+// writeJSON writes the rows as an array of objects keyed by the headers, in
+// the order of the headers
+func (r reportT) writeJSON(w io.Writer) error {
+	var b strings.Builder
+
+	b.WriteString("[")
+
+	for i, row := range r.rows {
+		if i > 0 {
+			b.WriteString(",")
+		}
+
+		b.WriteString("\n  {")
+
+		for j, v := range row {
+			if j > 0 {
+				b.WriteString(", ")
+			}
+
+			key, err := json.Marshal(r.headers[j])
+			if err != nil {
+				return err
+			}
+
+			value, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+
+			fmt.Fprintf(&b, "%s: %s", key, value)
+		}
+
+		b.WriteString("}")
+	}
+
+	b.WriteString("\n]\n")
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+func (r reportT) writeMarkdown(w io.Writer) error {
+	var b strings.Builder
+
+	escape := strings.NewReplacer("|", "\\|", "\n", " ")
+
+	line := func(fields []string) {
+		b.WriteString("|")
+
+		for _, f := range fields {
+			fmt.Fprintf(&b, " %s |", escape.Replace(f))
+		}
+
+		b.WriteString("\n")
+	}
+
+	fmt.Fprintf(&b, "## %s\n\n", r.title)
+
+	line(r.headers)
+
+	b.WriteString("|")
+	for range r.headers {
+		b.WriteString(" --- |")
+	}
+	b.WriteString("\n")
+
+	for _, row := range r.strings() {
+		line(row)
+	}
+
+	_, err := io.WriteString(w, b.String())
+
+	return err
+}
+
+// htmlReport is a page with no dependencies, its columns being sorted by
+// clicking their headers
+var htmlReport = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { padding: 4px 8px; border-bottom: 1px solid #ddd; white-space: nowrap; }
+th { cursor: pointer; text-align: left; background: #eee; position: sticky; top: 0; }
+th[data-order=asc]::after { content: " \25B2"; }
+th[data-order=desc]::after { content: " \25BC"; }
+tbody tr:hover { background: #f5f5f5; }
+</style>
+</head>
+<body>
+<h2>{{.Title}}</h2>
+<table>
+<thead><tr>{{range .Headers}}<th>{{.}}</th>{{end}}</tr></thead>
+<tbody>
+{{range .Rows}}<tr>{{range .}}<td>{{.}}</td>{{end}}</tr>
+{{end}}</tbody>
+</table>
+<script>
+document.querySelectorAll("th").forEach((th, column) => {
+  th.addEventListener("click", () => {
+    const tbody = th.closest("table").tBodies[0];
+    const order = th.dataset.order === "asc" ? "desc" : "asc";
+    const value = (row) => row.cells[column].textContent;
+    const compare = (a, b) => {
+      const x = value(a), y = value(b);
+      if (x === "" || y === "") return (x === "") - (y === "");
+      const n = Number(x) - Number(y);
+      const c = isNaN(n) ? x.localeCompare(y) : n;
+      return order === "asc" ? c : -c;
+    };
+    document.querySelectorAll("th").forEach((h) => delete h.dataset.order);
+    th.dataset.order = order;
+    Array.from(tbody.rows).sort(compare).forEach((row) => tbody.appendChild(row));
+  });
+});
+</script>
+</body>
+</html>
+`))
+
+func (r reportT) writeHTML(w io.Writer) error {
+	return htmlReport.Execute(w, struct {
+		Title   string
+		Headers []string
+		Rows    [][]string
+	}{r.title, r.headers, r.strings()})
+}